@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Xe/rhea/gemini"
+)
+
+// Abuse configures automatic banning of clients that get too many error
+// responses, such as scanners probing for /.env or /wp-admin. Banned
+// clients are disconnected before the TLS handshake.
+type Abuse struct {
+	// MaxErrors is the number of error responses a client may get within
+	// Window before it is banned.
+	MaxErrors int      `json:"max_errors"`
+	Window    Duration `json:"window"`
+
+	// BanDuration is how long offending clients are banned for.
+	BanDuration Duration `json:"ban_duration"`
+
+	// Statuses lists the statuses that count as errors. It defaults to all
+	// 5x statuses.
+	Statuses []int `json:"statuses"`
+
+	// IPv6Prefix is the prefix length IPv6 clients are banned by. It
+	// defaults to 64.
+	IPv6Prefix uint8 `json:"ipv6_prefix"`
+
+	// BanFile is where bans are saved so they survive restarts. If empty,
+	// bans are only kept in memory.
+	BanFile string `json:"ban_file"`
+
+	detector *gemini.AbuseDetector
+}
+
+func (a *Abuse) load() error {
+	if a.MaxErrors <= 0 {
+		return fmt.Errorf("max_errors must be positive")
+	}
+	if a.Window <= 0 || a.BanDuration <= 0 {
+		return fmt.Errorf("window and ban_duration must be set")
+	}
+	if a.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6_prefix must be at most 128")
+	}
+
+	bans := gemini.NewBanList()
+	if a.BanFile != "" {
+		var err error
+		bans, err = gemini.LoadBanList(a.BanFile)
+		if err != nil {
+			return fmt.Errorf("can't load bans: %v", err)
+		}
+	}
+	bans.IPv6Prefix = a.IPv6Prefix
+
+	a.detector = &gemini.AbuseDetector{
+		Bans:        bans,
+		MaxErrors:   a.MaxErrors,
+		Window:      a.Window.Duration(),
+		BanDuration: a.BanDuration.Duration(),
+	}
+
+	if len(a.Statuses) != 0 {
+		statuses := map[int]bool{}
+		for _, st := range a.Statuses {
+			statuses[st] = true
+		}
+		a.detector.IsError = func(status int) bool { return statuses[status] }
+	}
+
+	return nil
+}
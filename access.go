@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Xe/rhea/gemini"
+)
+
+// AccessRule restricts a path prefix of a site to a set of client
+// certificates.
+type AccessRule struct {
+	Path         string   `json:"path"`
+	Fingerprints []string `json:"fingerprints"`
+	Subjects     []string `json:"subjects"`
+
+	// AllowlistFile is the path of a file with more allowed certificates.
+	// It is read again when rhea gets SIGHUP. Every line is either
+	// "fingerprint <sha256 hex>" or "subject <name>". Blank lines and lines
+	// starting with # are ignored.
+	AllowlistFile string `json:"allowlist_file"`
+
+	// ClientCAFile is the path of a PEM bundle of certificate authorities.
+	// Subject entries only match certificates signed by one of them, and
+	// they are refused without it, because anybody can make a self-signed
+	// certificate with any subject.
+	ClientCAFile string `json:"client_ca_file"`
+
+	allowlist *gemini.CertAllowlist
+}
+
+// load (re)builds the allowlist of the rule from its static entries and its
+// allowlist file.
+func (ar *AccessRule) load() error {
+	fingerprints := append([]string(nil), ar.Fingerprints...)
+	subjects := append([]string(nil), ar.Subjects...)
+
+	if ar.AllowlistFile != "" {
+		fps, subs, err := readAllowlistFile(ar.AllowlistFile)
+		if err != nil {
+			return err
+		}
+		fingerprints = append(fingerprints, fps...)
+		subjects = append(subjects, subs...)
+	}
+
+	var roots *x509.CertPool
+	switch {
+	case ar.ClientCAFile != "":
+		data, err := os.ReadFile(ar.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("can't read client CA file: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in client CA file %s", ar.ClientCAFile)
+		}
+	case len(subjects) != 0:
+		return fmt.Errorf("access rule for %s has subject entries but no client_ca_file; client certificates aren't verified, so anybody could claim a subject", ar.Path)
+	}
+
+	if ar.allowlist == nil {
+		ar.allowlist = gemini.NewCertAllowlist(fingerprints, subjects, roots)
+	} else {
+		ar.allowlist.Replace(fingerprints, subjects, roots)
+	}
+
+	return nil
+}
+
+func readAllowlistFile(path string) (fingerprints, subjects []string, err error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fin.Close()
+
+	sc := bufio.NewScanner(fin)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return nil, nil, fmt.Errorf("%s:%d: missing value", path, lineno)
+		}
+
+		switch kind {
+		case "fingerprint":
+			fingerprints = append(fingerprints, value)
+		case "subject":
+			subjects = append(subjects, value)
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unknown entry kind %q", path, lineno, kind)
+		}
+	}
+
+	return fingerprints, subjects, sc.Err()
+}
+
+// accessRules converts the access rules of a site to gemini.AccessRules.
+func (s Site) accessRules() []gemini.AccessRule {
+	result := make([]gemini.AccessRule, 0, len(s.Access))
+	for _, ar := range s.Access {
+		result = append(result, gemini.AccessRule{
+			Prefix:     ar.Path,
+			Authorizer: ar.allowlist,
+		})
+	}
+	return result
+}
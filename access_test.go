@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+func TestSiteAccessReload(t *testing.T) {
+	block, _ := pem.Decode(certPem)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	allowlist := filepath.Join(dir, "allow")
+	if err := os.WriteFile(allowlist, []byte("# nobody yet\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rh, err := New(Config{
+		Sites: []Site{
+			{
+				Domain: "test.server",
+				Files:  &FileServer{Root: "./public"},
+				Access: []AccessRule{
+					{Path: "/test/", AllowlistFile: allowlist},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() int {
+		u, _ := url.Parse("gemini://test.server/test/hi.gmi")
+		rw := new(geminitest.ResponseRecorder)
+		rh.HandleGemini(rw, &gemini.Request{URL: u, Cert: cert})
+		return rw.StatusCode
+	}
+
+	if status := get(); status != gemini.StatusCertificateNotAuthorised {
+		t.Fatalf("wanted status code %d, got: %d", gemini.StatusCertificateNotAuthorised, status)
+	}
+
+	if err := os.WriteFile(allowlist, []byte("fingerprint "+gemini.Fingerprint(cert)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rh.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := get(); status != gemini.StatusSuccess {
+		t.Fatalf("wanted status code %d, got: %d", gemini.StatusSuccess, status)
+	}
+}
+
+func TestAccessRuleSubjectsNeedCA(t *testing.T) {
+	ar := AccessRule{Path: "/test/", Subjects: []string{"alice"}}
+	if err := ar.load(); err == nil {
+		t.Fatal("wanted an error for subjects without a client CA, got: nil")
+	}
+
+	dir := t.TempDir()
+	allowlist := filepath.Join(dir, "allow")
+	if err := os.WriteFile(allowlist, []byte("subject alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ar = AccessRule{Path: "/test/", AllowlistFile: allowlist}
+	if err := ar.load(); err == nil {
+		t.Fatal("wanted an error for subjects in the allowlist file without a client CA, got: nil")
+	}
+
+	ca := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(ca, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ar.ClientCAFile = ca
+	if err := ar.load(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// adminOnly protects an admin endpoint with the configured admin token.
+// The endpoints change state, so unlike the metrics they are not served at
+// all without a token.
+func (rh *Rhea) adminOnly(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || rh.cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(rh.cfg.AdminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	})
+}
+
+type banJSON struct {
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleBans manages the abuse ban list.
+//
+//	GET /admin/bans                        lists active bans
+//	POST /admin/bans ip=<ip>&duration=<d>  bans an address
+//	DELETE /admin/bans?ip=<ip>             lifts a ban
+func (rh *Rhea) handleBans(w http.ResponseWriter, r *http.Request) {
+	if rh.cfg.Abuse == nil {
+		http.Error(w, "abuse detection is not configured", http.StatusNotFound)
+		return
+	}
+	bans := rh.cfg.Abuse.detector.Bans
+
+	switch r.Method {
+	case http.MethodGet:
+		result := []banJSON{}
+		for _, ban := range bans.Bans() {
+			result = append(result, banJSON{IP: ban.String(), Expires: ban.Expires})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodPost:
+		ip, err := netaddr.ParseIP(r.FormValue("ip"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dur := rh.cfg.Abuse.BanDuration.Duration()
+		if d := r.FormValue("duration"); d != "" {
+			dur, err = time.ParseDuration(d)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := bans.Ban(ip, time.Now().Add(dur)); err != nil {
+			http.Error(w, fmt.Sprintf("can't save bans: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		ip, err := netaddr.ParseIP(r.FormValue("ip"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := bans.Unban(ip); err != nil {
+			http.Error(w, fmt.Sprintf("can't save bans: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCachePurge drops cached reverse proxy responses.
+//
+//	POST /admin/cache/purge domain=<site>&path=<prefix>
+//
+// Without a domain, the caches of all sites are purged. Without a path,
+// every response is dropped. The number of dropped responses is returned
+// as {"purged": n}.
+func (rh *Rhea) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain := r.FormValue("domain")
+	path := r.FormValue("path")
+
+	found := false
+	purged := 0
+	for _, site := range rh.cfg.Sites {
+		if domain != "" && site.Domain != domain {
+			continue
+		}
+		if site.ReverseProxy == nil || site.ReverseProxy.Cache == nil {
+			continue
+		}
+		found = true
+		purged += site.ReverseProxy.Cache.Purge(path)
+	}
+
+	if !found {
+		http.Error(w, "no cache is configured for that domain", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
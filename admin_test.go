@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestAdminBans(t *testing.T) {
+	rh, err := New(Config{
+		AdminToken: "hunter2",
+		Abuse: &Abuse{
+			MaxErrors:   5,
+			Window:      Duration(time.Minute),
+			BanDuration: Duration(time.Hour),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := httpMux(rh)
+
+	do := func(method, target string, body url.Values, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/admin/bans", nil, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wanted status %d without a token, got: %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/bans", nil)
+	req.Header.Set("Authorization", "hunter2")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wanted status %d for a token without the Bearer scheme, got: %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	rec = do(http.MethodPost, "/admin/bans", url.Values{"ip": {"192.0.2.1"}, "duration": {"10m"}}, "hunter2")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("wanted status %d, got: %d: %s", http.StatusNoContent, rec.Code, rec.Body)
+	}
+	if rh.allowedIP(netaddr.MustParseIP("192.0.2.1")) {
+		t.Fatal("banned address is still allowed to connect")
+	}
+
+	rec = do(http.MethodGet, "/admin/bans", nil, "hunter2")
+	var bans []banJSON
+	if err := json.NewDecoder(rec.Body).Decode(&bans); err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].IP != "192.0.2.1" {
+		t.Fatalf("wanted the ban to be listed, got: %v", bans)
+	}
+
+	rec = do(http.MethodDelete, "/admin/bans?ip=192.0.2.1", nil, "hunter2")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("wanted status %d, got: %d: %s", http.StatusNoContent, rec.Code, rec.Body)
+	}
+	if !rh.allowedIP(netaddr.MustParseIP("192.0.2.1")) {
+		t.Fatal("unbanned address is not allowed to connect")
+	}
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	rh, err := New(Config{
+		Abuse: &Abuse{
+			MaxErrors:   5,
+			Window:      Duration(time.Minute),
+			BanDuration: Duration(time.Hour),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/admin/bans", "/admin/cache/purge"} {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader("ip=192.0.2.1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		httpMux(rh).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("%s: wanted status %d without a configured token, got: %d", target, http.StatusNotFound, rec.Code)
+		}
+	}
+	if !rh.allowedIP(netaddr.MustParseIP("192.0.2.1")) {
+		t.Fatal("wanted the ban to be refused")
+	}
+}
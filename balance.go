@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/Xe/rhea/gemini"
+)
+
+// Load balancing strategies of a reverse proxy.
+const (
+	// strategyRandom picks upstreams at random.
+	strategyRandom = "random"
+
+	// strategyRoundRobin takes turns between upstreams.
+	strategyRoundRobin = "round_robin"
+
+	// strategyLeastConn picks the upstream with the fewest requests in
+	// flight.
+	strategyLeastConn = "least_conn"
+
+	// strategySticky sends all requests made with the same client
+	// certificate to the same upstream. Requests without a certificate are
+	// balanced by client address like with strategyIPHash.
+	strategySticky = "sticky"
+
+	// strategyIPHash sends all requests from the same client address to
+	// the same upstream.
+	strategyIPHash = "ip_hash"
+)
+
+// balancer orders the upstreams of a reverse proxy by preference for a
+// request. Upstreams with a bigger weight get proportionally more requests.
+type balancer struct {
+	strategy string
+
+	mu      sync.Mutex
+	current map[*Upstream]int // smooth weighted round robin state
+	active  map[*Upstream]int // requests in flight
+}
+
+func newBalancer(strategy string) (*balancer, error) {
+	switch strategy {
+	case "":
+		strategy = strategyRandom
+	case strategyRandom, strategyRoundRobin, strategyLeastConn, strategySticky, strategyIPHash:
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", strategy)
+	}
+
+	return &balancer{
+		strategy: strategy,
+		current:  map[*Upstream]int{},
+		active:   map[*Upstream]int{},
+	}, nil
+}
+
+// order sorts ups for r, most preferred first. The later upstreams are
+// where connecting is retried when the earlier ones are down.
+func (b *balancer) order(ups []*Upstream, r *gemini.Request) []*Upstream {
+	if len(ups) < 2 {
+		return ups
+	}
+
+	switch b.strategy {
+	case strategyRoundRobin:
+		return b.roundRobin(ups)
+	case strategyLeastConn:
+		return b.leastConn(ups)
+	case strategySticky:
+		if fp := r.Fingerprint(); fp != "" {
+			return rendezvous(ups, "cert:"+fp)
+		}
+		return rendezvous(ups, "ip:"+r.RemoteAddr.IP().String())
+	case strategyIPHash:
+		return rendezvous(ups, "ip:"+r.RemoteAddr.IP().String())
+	default:
+		return weightedShuffle(ups)
+	}
+}
+
+// roundRobin picks the next upstream like nginx's smooth weighted round
+// robin, which spreads the turns of heavy upstreams out instead of giving
+// them all in a row.
+func (b *balancer) roundRobin(ups []*Upstream) []*Upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total, best := 0, 0
+	for i, up := range ups {
+		b.current[up] += up.weight()
+		total += up.weight()
+		if b.current[up] > b.current[ups[best]] {
+			best = i
+		}
+	}
+	b.current[ups[best]] -= total
+
+	result := make([]*Upstream, 0, len(ups))
+	for i := range ups {
+		result = append(result, ups[(best+i)%len(ups)])
+	}
+	return result
+}
+
+// leastConn orders upstreams by their requests in flight relative to their
+// weight. Ties are broken at random.
+func (b *balancer) leastConn(ups []*Upstream) []*Upstream {
+	result := weightedShuffle(ups)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	load := func(up *Upstream) float64 { return float64(b.active[up]) / float64(up.weight()) }
+	sort.SliceStable(result, func(i, j int) bool { return load(result[i]) < load(result[j]) })
+	return result
+}
+
+// acquire counts a request in flight to up.
+func (b *balancer) acquire(up *Upstream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active[up]++
+}
+
+// release forgets a request counted by acquire.
+func (b *balancer) release(up *Upstream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active[up]--
+}
+
+// weightedShuffle orders upstreams at random, with heavier upstreams
+// more likely to come first.
+func weightedShuffle(ups []*Upstream) []*Upstream {
+	keys := make(map[*Upstream]float64, len(ups))
+	for _, up := range ups {
+		keys[up] = math.Pow(rand.Float64(), 1/float64(up.weight()))
+	}
+	return sortByScore(ups, keys)
+}
+
+// rendezvous orders upstreams by weighted rendezvous hashing of key. The
+// same key always gets the same order, and an upstream going away only
+// moves the keys that preferred it.
+func rendezvous(ups []*Upstream, key string) []*Upstream {
+	scores := make(map[*Upstream]float64, len(ups))
+	for _, up := range ups {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(up.URL))
+
+		// Map the hash into (0, 1).
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		scores[up] = float64(up.weight()) / -math.Log(u)
+	}
+	return sortByScore(ups, scores)
+}
+
+func sortByScore(ups []*Upstream, scores map[*Upstream]float64) []*Upstream {
+	result := append([]*Upstream(nil), ups...)
+	sort.SliceStable(result, func(i, j int) bool { return scores[result[i]] > scores[result[j]] })
+	return result
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/Xe/rhea/gemini"
+	"inet.af/netaddr"
+)
+
+func testUpstreams(weights ...int) []*Upstream {
+	var result []*Upstream
+	for i, w := range weights {
+		result = append(result, &Upstream{URL: fmt.Sprintf("tcp://127.0.0.1:%d", 2000+i), Weight: w})
+	}
+	return result
+}
+
+func testRequest(ip string) *gemini.Request {
+	u, _ := url.Parse("gemini://foo.local/")
+	return &gemini.Request{URL: u, RemoteAddr: netaddr.MustParseIPPort(ip + ":4000")}
+}
+
+func TestBalancerUnknownStrategy(t *testing.T) {
+	if _, err := newBalancer("fastest"); err == nil {
+		t.Fatal("wanted an error for an unknown strategy")
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b, _ := newBalancer(strategyRoundRobin)
+	ups := testUpstreams(1, 2)
+
+	counts := map[*Upstream]int{}
+	for i := 0; i < 30; i++ {
+		order := b.order(ups, testRequest("192.0.2.1"))
+		if len(order) != 2 {
+			t.Fatalf("wanted every upstream in the order, got: %d", len(order))
+		}
+		counts[order[0]]++
+	}
+
+	if counts[ups[0]] != 10 || counts[ups[1]] != 20 {
+		t.Fatalf("wanted a 10/20 split, got: %d/%d", counts[ups[0]], counts[ups[1]])
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	b, _ := newBalancer(strategyLeastConn)
+	ups := testUpstreams(1, 1)
+
+	b.acquire(ups[0])
+	for i := 0; i < 10; i++ {
+		if got := b.order(ups, testRequest("192.0.2.1"))[0]; got != ups[1] {
+			t.Fatalf("wanted the idle upstream, got: %s", got.URL)
+		}
+	}
+
+	b.acquire(ups[1])
+	b.acquire(ups[1])
+	b.release(ups[0])
+	if got := b.order(ups, testRequest("192.0.2.1"))[0]; got != ups[0] {
+		t.Fatalf("wanted the upstream with fewer requests, got: %s", got.URL)
+	}
+}
+
+func TestBalancerSticky(t *testing.T) {
+	for _, strategy := range []string{strategySticky, strategyIPHash} {
+		b, _ := newBalancer(strategy)
+		ups := testUpstreams(1, 1, 1)
+
+		seen := map[*Upstream]bool{}
+		for i := 0; i < 50; i++ {
+			r := testRequest(fmt.Sprintf("192.0.2.%d", i))
+			first := b.order(ups, r)
+			for j := 0; j < 5; j++ {
+				if got := b.order(ups, r)[0]; got != first[0] {
+					t.Fatalf("%s: wanted the same upstream every time, got %s and %s", strategy, first[0].URL, got.URL)
+				}
+			}
+
+			// Taking away an upstream the client doesn't use must not
+			// move it.
+			if got := b.order([]*Upstream{first[0], first[2]}, r)[0]; got != first[0] {
+				t.Fatalf("%s: wanted the client to stay on %s, got: %s", strategy, first[0].URL, got.URL)
+			}
+			seen[first[0]] = true
+		}
+
+		if len(seen) != len(ups) {
+			t.Fatalf("%s: wanted clients spread over all upstreams, got: %d", strategy, len(seen))
+		}
+	}
+}
+
+func TestBalancerStickyCertificate(t *testing.T) {
+	b, _ := newBalancer(strategySticky)
+	ups := testUpstreams(1, 1, 1, 1)
+	cert := newTestClientCert(t)
+
+	var want *Upstream
+	for i := 0; i < 20; i++ {
+		r := testRequest(fmt.Sprintf("192.0.2.%d", i))
+		r.Cert = cert
+		got := b.order(ups, r)[0]
+		if want == nil {
+			want = got
+		}
+		if got != want {
+			t.Fatalf("wanted the certificate to stick to %s from any address, got: %s", want.URL, got.URL)
+		}
+	}
+}
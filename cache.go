@@ -0,0 +1,381 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rhea_cache_requests_total",
+		Help: "The number of reverse proxy requests looked up in the cache, by result",
+	}, []string{"domain", "result"})
+
+	cacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rhea_cache_size_bytes",
+		Help: "The size of the responses in the reverse proxy cache",
+	}, []string{"domain"})
+
+	cacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rhea_cache_entries",
+		Help: "The number of responses in the reverse proxy cache",
+	}, []string{"domain"})
+)
+
+// Results of a cache lookup.
+const (
+	// cacheHit is a fresh response served from the cache.
+	cacheHit = "hit"
+	// cacheMiss is a response fetched from an upstream.
+	cacheMiss = "miss"
+	// cacheCoalesced is a response fetched for another request to the
+	// same URL that was in flight.
+	cacheCoalesced = "coalesced"
+	// cacheStale is an expired response served because the upstreams
+	// failed.
+	cacheStale = "stale"
+)
+
+// Defaults for caching.
+const (
+	defaultCacheMaxSize      = 64 << 20
+	defaultCacheMaxEntrySize = 1 << 20
+	defaultCacheTTL          = time.Minute
+)
+
+// Cache keeps successful (status 20) responses of a reverse proxy in memory
+// so identical requests don't all go to the upstreams. Concurrent requests for a URL
+// that isn't cached are coalesced into one upstream request. Requests made
+// with a client certificate are never cached, since their responses are
+// likely meant for that client only.
+type Cache struct {
+	// MaxSize is the total size in bytes of the cached responses. When it
+	// is reached, the least recently used responses are dropped. It
+	// defaults to 64 MiB.
+	MaxSize int64 `json:"max_size"`
+
+	// MaxEntrySize is the size in bytes of the biggest response that is
+	// cached. It defaults to 1 MiB.
+	MaxEntrySize int64 `json:"max_entry_size"`
+
+	// TTL is how long responses stay fresh. It defaults to one minute.
+	TTL Duration `json:"ttl"`
+
+	// Rules set the TTL of paths that start with a prefix.
+	Rules []CacheRule `json:"rules"`
+
+	// ServeStale is how long after they expire responses may still be
+	// served when the upstreams fail.
+	ServeStale Duration `json:"serve_stale"`
+
+	domain  string
+	flights flightGroup
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	size    int64
+}
+
+// CacheRule sets the TTL of the responses under a path prefix. When
+// several rules match a path, the one with the longest prefix applies.
+type CacheRule struct {
+	Path string `json:"path"`
+
+	// TTL is how long responses stay fresh. Zero means they are not
+	// cached at all.
+	TTL Duration `json:"ttl"`
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	key        string
+	path       string
+	status     int
+	meta       string
+	body       []byte
+	expires    time.Time
+	staleUntil time.Time
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.meta) + len(e.body))
+}
+
+func (e *cacheEntry) write(w gemini.ResponseWriter) {
+	w.Status(e.status, e.meta)
+	w.Write(e.body)
+}
+
+func (c *Cache) load(domain string) error {
+	if c.MaxSize < 0 || c.MaxEntrySize < 0 {
+		return fmt.Errorf("sizes must not be negative")
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultCacheMaxSize
+	}
+	if c.MaxEntrySize == 0 {
+		c.MaxEntrySize = defaultCacheMaxEntrySize
+	}
+	if c.TTL == 0 {
+		c.TTL = Duration(defaultCacheTTL)
+	}
+
+	c.domain = domain
+	c.entries = map[string]*list.Element{}
+	return nil
+}
+
+// cacheable reports whether the response to r may be cached.
+func cacheable(r *gemini.Request) bool {
+	return r.Fingerprint() == ""
+}
+
+// ttl returns how long responses for path stay fresh.
+func (c *Cache) ttl(path string) time.Duration {
+	var rule *CacheRule
+	for i := range c.Rules {
+		if !strings.HasPrefix(path, c.Rules[i].Path) {
+			continue
+		}
+		if rule == nil || len(c.Rules[i].Path) > len(rule.Path) {
+			rule = &c.Rules[i]
+		}
+	}
+
+	if rule == nil {
+		return c.TTL.Duration()
+	}
+	return rule.TTL.Duration()
+}
+
+// handle answers r from the cache, or from roundTrip if it isn't cached.
+func (c *Cache) handle(w gemini.ResponseWriter, r *gemini.Request, roundTrip func(*gemini.Request) (*gemini.Response, func(), error)) {
+	key := r.URL.String()
+	if e := c.get(key); e != nil && time.Now().Before(e.expires) {
+		c.count(cacheHit)
+		e.write(w)
+		return
+	}
+
+	f, leader := c.flights.join(key)
+	if !leader {
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+
+		switch {
+		case f.entry != nil:
+			c.count(cacheCoalesced)
+			f.entry.write(w)
+		case f.abandoned:
+			// The leader's client went away, which says nothing about the
+			// upstream, so try again.
+			c.handle(w, r, roundTrip)
+		case f.err != nil:
+			c.fail(w, key, f.err)
+		default:
+			// The response was too big to share, so get one of our own.
+			c.count(cacheMiss)
+			resp, done, err := roundTrip(r)
+			if err != nil {
+				c.fail(w, key, err)
+				return
+			}
+			defer done()
+			w.Status(resp.Status, resp.Meta)
+			copyBody(w, resp.Body)
+		}
+		return
+	}
+
+	// Followers must not wait forever if roundTrip panics.
+	defer c.flights.finish(key, f)
+
+	c.count(cacheMiss)
+	resp, done, err := roundTrip(r)
+	if err != nil {
+		f.err = err
+		f.abandoned = r.Context().Err() != nil
+		c.flights.finish(key, f)
+		c.fail(w, key, err)
+		return
+	}
+	defer done()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.MaxEntrySize+1))
+	if err != nil {
+		f.err = err
+		f.abandoned = r.Context().Err() != nil
+		c.flights.finish(key, f)
+		c.fail(w, key, err)
+		return
+	}
+
+	if int64(len(body)) > c.MaxEntrySize {
+		c.flights.finish(key, f)
+		w.Status(resp.Status, resp.Meta)
+		w.Write(body)
+		copyBody(w, resp.Body)
+		return
+	}
+
+	e := &cacheEntry{
+		key:    key,
+		path:   r.URL.Path,
+		status: resp.Status,
+		meta:   resp.Meta,
+		body:   body,
+	}
+	if ttl := c.ttl(r.URL.Path); resp.Status == gemini.StatusSuccess && ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+		e.staleUntil = e.expires.Add(c.ServeStale.Duration())
+		c.put(e)
+	}
+
+	f.entry = e
+	c.flights.finish(key, f)
+	e.write(w)
+}
+
+// fail answers a request whose upstream request failed with a stale
+// response if there is one, or with a proxy error.
+func (c *Cache) fail(w gemini.ResponseWriter, key string, err error) {
+	if e := c.get(key); e != nil && time.Now().Before(e.staleUntil) {
+		c.count(cacheStale)
+		e.write(w)
+		return
+	}
+	w.Status(gemini.StatusProxyError, err.Error())
+}
+
+func (c *Cache) count(result string) {
+	cacheRequests.With(prometheus.Labels{"domain": c.domain, "result": result}).Inc()
+}
+
+// get returns the entry for key if it is fresh or may still be served
+// stale.
+func (c *Cache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.staleUntil) {
+		c.removeLocked(el)
+		c.reportLocked()
+		return nil
+	}
+
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// put adds e to the cache, replacing any entry with the same key.
+func (c *Cache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+
+	for c.size > c.MaxSize && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+	}
+	c.reportLocked()
+}
+
+// Purge drops the cached responses for paths starting with prefix and
+// returns how many were dropped.
+func (c *Cache) Purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, el := range c.entries {
+		if strings.HasPrefix(el.Value.(*cacheEntry).path, prefix) {
+			c.removeLocked(el)
+			n++
+		}
+	}
+	c.reportLocked()
+	return n
+}
+
+// removeLocked drops an entry. c.mu must be held.
+func (c *Cache) removeLocked(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+// reportLocked updates the cache gauges. c.mu must be held.
+func (c *Cache) reportLocked() {
+	cacheSize.With(prometheus.Labels{"domain": c.domain}).Set(float64(c.size))
+	cacheEntries.With(prometheus.Labels{"domain": c.domain}).Set(float64(c.lru.Len()))
+}
+
+// flightGroup coalesces concurrent fetches of the same key into one.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a fetch in progress. Once done is closed, entry holds the
+// response if it can be shared and err holds the error if the fetch
+// failed. If it failed because the client of the leader went away,
+// abandoned is set too.
+type flight struct {
+	done      chan struct{}
+	entry     *cacheEntry
+	err       error
+	abandoned bool
+
+	once sync.Once
+}
+
+// join returns the flight for key. If there was none, a new one is started
+// and the caller is its leader, which must call finish when it is done.
+func (g *flightGroup) join(key string) (f *flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	f = &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish ends a flight and wakes up everyone waiting on it. Calls after
+// the first do nothing.
+func (g *flightGroup) finish(key string, f *flight) {
+	f.once.Do(func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+
+		close(f.done)
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+// cachingProxy starts a backend that counts its requests and a reverse
+// proxy with cache in front of it.
+func cachingProxy(t *testing.T, cache *Cache, h gemini.HandlerFunc) (*ReverseProxy, *int64, *gemini.Server) {
+	t.Helper()
+
+	var hits int64
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := gemini.NewServer(gemini.HandlerFunc(func(w gemini.ResponseWriter, r *gemini.Request) {
+		n := atomic.AddInt64(&hits, 1)
+		if h != nil {
+			h(w, r)
+			return
+		}
+		w.Status(gemini.StatusSuccess, "text/gemini")
+		fmt.Fprintf(w, "response %d for %s", n, r.URL.Path)
+	}))
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	rp := &ReverseProxy{
+		To:     []string{"tcp://" + l.Addr().String()},
+		Domain: "test.server",
+		Cache:  cache,
+	}
+	if err := rp.load(); err != nil {
+		t.Fatal(err)
+	}
+	return rp, &hits, s
+}
+
+func proxyGet(rp *ReverseProxy, path string) *geminitest.ResponseRecorder {
+	u, _ := url.Parse("gemini://foo.local" + path)
+	rw := &geminitest.ResponseRecorder{}
+	rp.HandleGemini(rw, &gemini.Request{URL: u})
+	if rw.Body == nil {
+		rw.Write(nil)
+	}
+	return rw
+}
+
+func TestCacheHit(t *testing.T) {
+	rp, hits, _ := cachingProxy(t, &Cache{
+		Rules: []CacheRule{{Path: "/live", TTL: 0}},
+	}, nil)
+
+	first := proxyGet(rp, "/page")
+	second := proxyGet(rp, "/page")
+	if first.Body.String() != "response 1 for /page" || second.Body.String() != first.Body.String() {
+		t.Fatalf("wanted the cached response twice, got: %q and %q", first.Body, second.Body)
+	}
+	if *hits != 1 {
+		t.Fatalf("wanted 1 upstream request, got: %d", *hits)
+	}
+
+	proxyGet(rp, "/live")
+	proxyGet(rp, "/live")
+	if *hits != 3 {
+		t.Fatalf("wanted paths with a zero TTL not to be cached, got %d upstream requests", *hits)
+	}
+
+	cert := newTestClientCert(t)
+	u, _ := url.Parse("gemini://foo.local/page")
+	rw := new(geminitest.ResponseRecorder)
+	rp.HandleGemini(rw, &gemini.Request{URL: u, Cert: cert})
+	if *hits != 4 {
+		t.Fatalf("wanted requests with a client certificate to bypass the cache, got %d upstream requests", *hits)
+	}
+}
+
+func TestCacheOnlySuccess(t *testing.T) {
+	rp, hits, _ := cachingProxy(t, &Cache{}, func(w gemini.ResponseWriter, r *gemini.Request) {
+		w.Status(gemini.StatusNotFound, "not found")
+	})
+
+	proxyGet(rp, "/missing")
+	if rw := proxyGet(rp, "/missing"); rw.StatusCode != gemini.StatusNotFound {
+		t.Fatalf("wanted status code %d, got: %d", gemini.StatusNotFound, rw.StatusCode)
+	}
+	if *hits != 2 {
+		t.Fatalf("wanted error responses not to be cached, got %d upstream requests", *hits)
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	release := make(chan struct{})
+	rp, hits, _ := cachingProxy(t, &Cache{}, func(w gemini.ResponseWriter, r *gemini.Request) {
+		<-release
+		w.Status(gemini.StatusSuccess, "text/gemini")
+		fmt.Fprint(w, "slow")
+	})
+
+	var wg sync.WaitGroup
+	results := make([]*geminitest.ResponseRecorder, 5)
+	for i := range results {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = proxyGet(rp, "/slow")
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for _, rw := range results {
+		if rw.StatusCode != gemini.StatusSuccess || rw.Body.String() != "slow" {
+			t.Fatalf("wanted every request to get the response, got: %d %q", rw.StatusCode, rw.Body)
+		}
+	}
+	if got := atomic.LoadInt64(hits); got != 1 {
+		t.Fatalf("wanted concurrent requests to be coalesced, got %d upstream requests", got)
+	}
+}
+
+func TestCacheCoalescingLeaderGone(t *testing.T) {
+	release := make(chan struct{})
+	rp, hits, _ := cachingProxy(t, &Cache{}, func(w gemini.ResponseWriter, r *gemini.Request) {
+		<-release
+		w.Status(gemini.StatusSuccess, "text/gemini")
+		fmt.Fprint(w, "slow")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		u, _ := url.Parse("gemini://foo.local/slow")
+		req := (&gemini.Request{URL: u}).WithContext(ctx)
+		rp.HandleGemini(&geminitest.ResponseRecorder{}, req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	followerDone := make(chan *geminitest.ResponseRecorder)
+	go func() { followerDone <- proxyGet(rp, "/slow") }()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	<-leaderDone
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	rw := <-followerDone
+	if rw.StatusCode != gemini.StatusSuccess || rw.Body.String() != "slow" {
+		t.Fatalf("wanted the follower to get the response, got: %d %s %q", rw.StatusCode, rw.Meta, rw.Body)
+	}
+	if got := atomic.LoadInt64(hits); got != 2 {
+		t.Fatalf("wanted the follower to fetch again, got %d upstream requests", got)
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	for _, tt := range []struct {
+		serveStale time.Duration
+		want       int
+	}{
+		{time.Hour, gemini.StatusSuccess},
+		{0, gemini.StatusProxyError},
+	} {
+		rp, _, s := cachingProxy(t, &Cache{
+			TTL:        Duration(10 * time.Millisecond),
+			ServeStale: Duration(tt.serveStale),
+		}, nil)
+
+		proxyGet(rp, "/page")
+		s.Close()
+		time.Sleep(20 * time.Millisecond)
+
+		if rw := proxyGet(rp, "/page"); rw.StatusCode != tt.want {
+			t.Fatalf("serve_stale %s: wanted status code %d, got: %d %s", tt.serveStale, tt.want, rw.StatusCode, rw.Meta)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := &Cache{MaxSize: 100}
+	if err := c.load("test.server"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		c.put(&cacheEntry{
+			key:        key,
+			body:       []byte(strings.Repeat("a", 30)),
+			expires:    time.Now().Add(time.Hour),
+			staleUntil: time.Now().Add(time.Hour),
+		})
+		if i == 2 {
+			// Keep k0 in use so it outlives the entries added after it.
+			c.get("k0")
+		}
+	}
+
+	if c.size > c.MaxSize {
+		t.Fatalf("wanted the cache to stay under %d bytes, got: %d", c.MaxSize, c.size)
+	}
+	if c.get("k0") == nil || c.get("k4") == nil {
+		t.Fatal("wanted recently used entries to be kept")
+	}
+	if c.get("k1") != nil || c.get("k2") != nil {
+		t.Fatal("wanted the least recently used entries to be dropped")
+	}
+}
+
+func TestAdminCachePurge(t *testing.T) {
+	rh, err := New(Config{
+		AdminToken: "hunter2",
+		Sites: []Site{{
+			Domain: "foo.local",
+			ReverseProxy: &ReverseProxy{
+				To:     []string{"tcp://127.0.0.1:1"},
+				Domain: "test.server",
+				Cache:  &Cache{},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rh.cfg.Sites[0].ReverseProxy.Cache
+	for _, path := range []string{"/a/1", "/a/2", "/b"} {
+		c.put(&cacheEntry{
+			key:        "gemini://test.server" + path,
+			path:       path,
+			expires:    time.Now().Add(time.Hour),
+			staleUntil: time.Now().Add(time.Hour),
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/cache/purge", strings.NewReader("domain=foo.local&path=/a/"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer hunter2")
+	rec := httptest.NewRecorder()
+	httpMux(rh).ServeHTTP(rec, req)
+
+	var result struct{ Purged int }
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Purged != 2 {
+		t.Fatalf("wanted 2 responses purged, got: %d", result.Purged)
+	}
+	if c.get("gemini://test.server/b") == nil {
+		t.Fatal("wanted responses outside the path to be kept")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/cache/purge", strings.NewReader("domain=bar.local"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer hunter2")
+	rec = httptest.NewRecorder()
+	httpMux(rh).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("wanted status %d for a site without a cache, got: %d", http.StatusNotFound, rec.Code)
+	}
+}
@@ -1,9 +1,64 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+)
+
 type Config struct {
 	Port     uint16 `json:"port"`
 	HTTPPort uint16 `json:"http_port"`
 	Sites    []Site `json:"sites"`
+
+	HandshakeTimeout Duration `json:"handshake_timeout"`
+	ReadTimeout      Duration `json:"read_timeout"`
+	WriteTimeout     Duration `json:"write_timeout"`
+
+	// KnownHosts is the path of a file where the certificates of tls://
+	// reverse proxy upstreams with insecure_skip_verify and of servers
+	// fetched by the forward proxy are trusted on first use. If empty, the
+	// certificates of those upstreams are not verified at all and the
+	// forward proxy only remembers server certificates until rhea restarts.
+	KnownHosts string `json:"known_hosts"`
+
+	// ProxyProtocol reads the addresses of clients from PROXY protocol
+	// headers sent by a load balancer in front of rhea.
+	ProxyProtocol *ProxyProtocol `json:"proxy_protocol"`
+
+	// IPRules filters clients of all sites. Denied clients are disconnected
+	// before the TLS handshake.
+	IPRules *IPRules `json:"ip_rules"`
+
+	// RateLimit limits how fast clients may make requests to any site.
+	RateLimit *RateLimit `json:"rate_limit"`
+
+	// MaxConnections limits how many gemini connections are open at once.
+	// Further connections wait to be accepted.
+	MaxConnections int `json:"max_connections"`
+
+	// MaxConnectionsPerIP limits how many gemini connections a single
+	// address may have open at once. Further connections are answered with
+	// 44 SLOW DOWN.
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+
+	// Abuse bans clients that get too many error responses.
+	Abuse *Abuse `json:"abuse"`
+
+	// ForwardProxy fetches requests for hosts that aren't one of the sites
+	// from their own servers. If it is not set, such requests are refused.
+	ForwardProxy *ForwardProxy `json:"forward_proxy"`
+
+	// WebGateway serves the sites over HTTP on HTTPPort as well, rendering
+	// gemtext as HTML.
+	WebGateway *WebGateway `json:"web_gateway"`
+
+	// AdminToken protects the admin endpoints on the HTTP port. Requests
+	// must send it as "Authorization: Bearer <token>". If empty, the admin
+	// endpoints are not served.
+	AdminToken string `json:"admin_token"`
 }
 
 type Site struct {
@@ -11,6 +66,58 @@ type Site struct {
 	CertPath string `json:"cert_path"`
 	KeyPath  string `json:"key_path"`
 
+	// RequestClientCerts asks clients connecting to this site for a client
+	// certificate. Clients may still choose not to send one.
+	RequestClientCerts bool `json:"request_client_certs"`
+
+	// Access restricts parts of the site to certain client certificates.
+	// Client certificates are requested automatically when it is set.
+	Access []AccessRule `json:"access"`
+
+	// IPRules filters clients of this site. Denied clients are answered
+	// with a 53 status.
+	IPRules *IPRules `json:"ip_rules"`
+
+	// RateLimit limits how fast clients may make requests to this site, on
+	// top of the global rate limit.
+	RateLimit *RateLimit `json:"rate_limit"`
+
+	// MaxConcurrentRequests limits how many requests to this site are
+	// handled at once. Further requests are answered with 41 SERVER
+	// UNAVAILABLE.
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	concurrency *gemini.ConcurrencyLimiter
+
+	// HandlerTimeout limits how long a request to this site may take
+	// before it is answered with a temporary failure.
+	HandlerTimeout Duration `json:"handler_timeout"`
+
 	Files        *FileServer   `json:"files"`
 	ReverseProxy *ReverseProxy `json:"reverse_proxy"`
+	HTTPBackend  *HTTPBackend  `json:"http_backend"`
+}
+
+// Duration is a time.Duration that is written in config files as a string
+// such as "30s" or "1m30s".
+type Duration time.Duration
+
+// Duration returns d as a time.Duration.
+func (d Duration) Duration() time.Duration { return time.Duration(d) }
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
 }
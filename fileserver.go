@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"mime"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 	"strings"
 
 	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/gemtext"
 )
 
 type FileServer struct {
@@ -37,16 +39,17 @@ func (f FileServer) writeIndex(path string, r *gemini.Request, w gemini.Response
 
 	w.Status(gemini.StatusSuccess, "text/gemini")
 
-	fmt.Fprintf(w, "# %s\n", r.URL.Path)
-	fmt.Fprintln(w)
-	fmt.Fprintln(w, "=> .. ..")
+	gw := gemtext.NewWriter(w)
+	gw.Heading(1, r.URL.Path)
+	gw.Text("")
+	gw.Link("..", "..")
 
 	for _, name := range names {
-		fmt.Fprintf(w, "=> ./%[1]s %[1]s", name)
+		gw.Link("./"+url.PathEscape(name), name)
 	}
 
-	fmt.Fprintln(w)
-	fmt.Fprintln(w, "Served by rhea")
+	gw.Text("")
+	gw.Text("Served by rhea")
 }
 
 func (f FileServer) serveFile(path string, w gemini.ResponseWriter) {
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+func TestFileServerIndex(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.gmi", "a file.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := FileServer{Root: dir, AutoIndex: true}
+	u, _ := url.Parse("gemini://example.com/")
+	rw := new(geminitest.ResponseRecorder)
+	f.HandleGemini(rw, &gemini.Request{URL: u})
+
+	want := "# /\n\n=> .. ..\n=> ./a%20file.txt a file.txt\n=> ./b.gmi b.gmi\n\nServed by rhea\n"
+	if rw.StatusCode != gemini.StatusSuccess || rw.Body.String() != want {
+		t.Fatalf("wanted index %q, got: %d %q", want, rw.StatusCode, rw.Body.String())
+	}
+}
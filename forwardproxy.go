@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var forwardProxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rhea_forward_proxy_requests_total",
+	Help: "The number of requests to the forward proxy, by outcome",
+}, []string{"outcome"})
+
+// Outcomes of a forward proxy request.
+const (
+	forwardFetched      = "fetched"
+	forwardRefused      = "refused"
+	forwardUnauthorized = "unauthorized"
+	forwardError        = "error"
+)
+
+// Defaults for the forward proxy.
+const (
+	defaultForwardMaxBodySize = 16 << 20
+	defaultForwardTimeout     = time.Minute
+)
+
+// errForwardLoop is returned when the forward proxy would connect to rhea
+// itself, which would pass the request back to the forward proxy forever.
+var errForwardLoop = errors.New("that is rhea itself")
+
+// ForwardProxy fetches requests for hosts that rhea doesn't serve itself
+// from their own servers. This lets clients that can't talk to the rest of
+// Geminispace, or shouldn't, go through rhea instead. Server certificates
+// are trusted on first use like gemini clients do.
+type ForwardProxy struct {
+	// Hosts are the hosts that may be fetched. "example.com" allows only
+	// that host, "*.example.com" its subdomains and "*" any host. A port may
+	// be given, as in "example.com:1966" or "example.com:*"; without one,
+	// only the default port is allowed. Careful: "*" lets clients reach
+	// internal servers too. rhea's own gemini port on this machine is
+	// never fetched, whatever name it is asked for under.
+	Hosts []string `json:"hosts"`
+
+	// Clients are the SHA-256 fingerprints of the client certificates that
+	// may use the proxy. If empty, anyone may.
+	Clients []string `json:"clients"`
+
+	// MaxBodySize is the size in bytes of the biggest response that is
+	// passed on. Bigger responses are cut off. It defaults to 16 MiB.
+	MaxBodySize int64 `json:"max_body_size"`
+
+	// Timeout is how long fetching a response may take, including its
+	// body. It defaults to one minute.
+	Timeout Duration `json:"timeout"`
+
+	// Cache keeps responses in memory. Unlike with reverse proxies,
+	// responses are shared between clients with certificates, since the
+	// certificates aren't passed on to the servers.
+	Cache *Cache `json:"cache"`
+
+	clients map[string]bool
+	client  *gemini.Client
+	port    string
+}
+
+// load checks the settings of the proxy. Server certificates are recorded
+// in kh. port is the port rhea serves gemini on, which the proxy refuses to
+// connect to on this machine.
+func (fp *ForwardProxy) load(kh *gemini.KnownHosts, port uint16) error {
+	if len(fp.Hosts) == 0 {
+		return fmt.Errorf("no hosts allowed")
+	}
+	for _, pattern := range fp.Hosts {
+		if pattern == "" {
+			return fmt.Errorf("empty host pattern")
+		}
+	}
+
+	fp.clients = make(map[string]bool, len(fp.Clients))
+	for _, fingerprint := range fp.Clients {
+		fp.clients[strings.ToLower(fingerprint)] = true
+	}
+
+	if fp.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size must not be negative")
+	}
+	if fp.MaxBodySize == 0 {
+		fp.MaxBodySize = defaultForwardMaxBodySize
+	}
+	if fp.Timeout <= 0 {
+		fp.Timeout = Duration(defaultForwardTimeout)
+	}
+
+	if fp.Cache != nil {
+		if err := fp.Cache.load("forward_proxy"); err != nil {
+			return fmt.Errorf("cache: %v", err)
+		}
+	}
+
+	fp.port = strconv.Itoa(int(port))
+	fp.client = &gemini.Client{
+		DialContext: func(ctx context.Context, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			d := tls.Dialer{
+				NetDialer: &net.Dialer{Control: fp.refuseSelf},
+				Config: &tls.Config{
+					InsecureSkipVerify:    true,
+					MinVersion:            tls.VersionTLS12,
+					ServerName:            host,
+					VerifyPeerCertificate: kh.VerifyPeerCertificate(addr),
+				},
+			}
+			return d.DialContext(ctx, "tcp", addr)
+		},
+		// Redirects are the client's business.
+		CheckRedirect: func(*gemini.Request, []*gemini.Request) error {
+			return gemini.ErrUseLastResponse
+		},
+		MaxBodySize: fp.MaxBodySize,
+		Timeout:     fp.Timeout.Duration(),
+	}
+
+	return nil
+}
+
+// allowedHost reports whether the host of a URL matches one of the allowed
+// patterns.
+func (fp *ForwardProxy) allowedHost(host, port string) bool {
+	if port == "" {
+		port = gemini.DefaultPort
+	}
+
+	for _, pattern := range fp.Hosts {
+		patternHost, patternPort := pattern, gemini.DefaultPort
+		if h, p, err := net.SplitHostPort(pattern); err == nil {
+			patternHost, patternPort = h, p
+		}
+
+		if patternPort != "*" && patternPort != port {
+			continue
+		}
+
+		switch {
+		case patternHost == "*":
+			return true
+		case strings.HasPrefix(patternHost, "*."):
+			if len(host) > len(patternHost)-1 && strings.EqualFold(host[len(host)-len(patternHost)+1:], patternHost[1:]) {
+				return true
+			}
+		case strings.EqualFold(host, patternHost):
+			return true
+		}
+	}
+
+	return false
+}
+
+// refuseSelf stops connections to rhea's own gemini port on a loopback or
+// local address. It runs once the name of the server is resolved, so it
+// catches any name that points back at rhea.
+func (fp *ForwardProxy) refuseSelf(network, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if port != fp.port {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return errForwardLoop
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return errForwardLoop
+		}
+	}
+	return nil
+}
+
+func (fp *ForwardProxy) HandleGemini(w gemini.ResponseWriter, r *gemini.Request) {
+	if len(fp.clients) != 0 {
+		if r.Fingerprint() == "" {
+			forwardProxyRequests.With(prometheus.Labels{"outcome": forwardUnauthorized}).Inc()
+			w.Status(gemini.StatusClientCertificateRequired, "a client certificate is needed to use this proxy")
+			return
+		}
+		if !fp.clients[r.Fingerprint()] {
+			forwardProxyRequests.With(prometheus.Labels{"outcome": forwardUnauthorized}).Inc()
+			w.Status(gemini.StatusCertificateNotAuthorised, "this certificate may not use this proxy")
+			return
+		}
+	}
+
+	if r.URL.Scheme != "gemini" || !fp.allowedHost(r.URL.Hostname(), r.URL.Port()) {
+		forwardProxyRequests.With(prometheus.Labels{"outcome": forwardRefused}).Inc()
+		w.Status(gemini.StatusProxyRequestRefused, fmt.Sprintf("can't proxy to %s", r.URL.Host))
+		return
+	}
+
+	if fp.Cache != nil {
+		fp.Cache.handle(w, r, fp.roundTrip)
+		return
+	}
+
+	resp, done, err := fp.roundTrip(r)
+	if err != nil {
+		w.Status(gemini.StatusProxyError, err.Error())
+		return
+	}
+	defer done()
+
+	w.Status(resp.Status, resp.Meta)
+	copyBody(w, resp.Body)
+}
+
+// roundTrip fetches r from its server. The caller must call done once it is
+// finished with the response body.
+func (fp *ForwardProxy) roundTrip(r *gemini.Request) (*gemini.Response, func(), error) {
+	// Only the URL is passed on. The client's certificate is for rhea, not
+	// for the server.
+	req, err := gemini.NewRequestWithContext(r.Context(), r.URL.String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := fp.client.Do(req)
+	if err != nil {
+		forwardProxyRequests.With(prometheus.Labels{"outcome": forwardError}).Inc()
+
+		var mismatch *gemini.CertificateMismatchError
+		if errors.As(err, &mismatch) {
+			return nil, nil, fmt.Errorf("certificate of %s changed", r.URL.Host)
+		}
+		if errors.Is(err, errForwardLoop) {
+			return nil, nil, fmt.Errorf("can't proxy to %s: %v", r.URL.Host, errForwardLoop)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, nil, fmt.Errorf("%s took too long to answer", r.URL.Host)
+		}
+		return nil, nil, err
+	}
+	forwardProxyRequests.With(prometheus.Labels{"outcome": forwardFetched}).Inc()
+
+	return resp, func() { resp.Body.Close() }, nil
+}
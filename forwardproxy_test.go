@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+// originServer starts a gemini server on localhost that answers with body
+// and returns its address.
+func originServer(t *testing.T, body string) string {
+	t.Helper()
+
+	cert := geminitest.NewCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}}, nil)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := gemini.NewServer(gemini.HandlerFunc(func(w gemini.ResponseWriter, r *gemini.Request) {
+		w.Status(gemini.StatusSuccess, "text/plain")
+		fmt.Fprint(w, body)
+	}))
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return l.Addr().String()
+}
+
+func TestForwardProxy(t *testing.T) {
+	addr := originServer(t, "hello")
+	_, port, _ := net.SplitHostPort(addr)
+	kh := gemini.NewKnownHosts()
+
+	fp := &ForwardProxy{Hosts: []string{"127.0.0.1:" + port}}
+	if err := fp.load(kh, 1965); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("gemini://" + addr + "/")
+	rw := new(geminitest.ResponseRecorder)
+	fp.HandleGemini(rw, &gemini.Request{URL: u})
+
+	if rw.StatusCode != gemini.StatusSuccess || rw.Body.String() != "hello" {
+		t.Fatalf("wanted the origin's response, got: %d %s", rw.StatusCode, rw.Meta)
+	}
+	if _, ok := kh.Lookup(addr); !ok {
+		t.Fatal("wanted the origin's certificate to be trusted on first use")
+	}
+
+	for _, refused := range []string{"gemini://127.0.0.2:" + port + "/", "gemini://127.0.0.1/", "https://" + addr + "/"} {
+		u, _ := url.Parse(refused)
+		rw := new(geminitest.ResponseRecorder)
+		fp.HandleGemini(rw, &gemini.Request{URL: u})
+
+		if rw.StatusCode != gemini.StatusProxyRequestRefused {
+			t.Fatalf("%s: wanted status code %d, got: %d %s", refused, gemini.StatusProxyRequestRefused, rw.StatusCode, rw.Meta)
+		}
+	}
+}
+
+func TestForwardProxyRefusesSelf(t *testing.T) {
+	// The origin stands in for rhea listening on its port.
+	addr := originServer(t, "hello")
+	_, port, _ := net.SplitHostPort(addr)
+	rheaPort, _ := strconv.Atoi(port)
+
+	fp := &ForwardProxy{Hosts: []string{"*:*"}}
+	if err := fp.load(gemini.NewKnownHosts(), uint16(rheaPort)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"gemini://" + addr + "/", "gemini://localhost:" + port + "/"} {
+		u, _ := url.Parse(target)
+		rw := new(geminitest.ResponseRecorder)
+		fp.HandleGemini(rw, &gemini.Request{URL: u})
+
+		if rw.StatusCode != gemini.StatusProxyError || !strings.Contains(rw.Meta, "rhea itself") {
+			t.Fatalf("%s: wanted the proxy to refuse to connect to itself, got: %d %s", target, rw.StatusCode, rw.Meta)
+		}
+	}
+}
+
+func TestForwardProxyAllowedHost(t *testing.T) {
+	fp := &ForwardProxy{Hosts: []string{"example.com", "*.example.org", "*:1966", "capsule.net:*"}}
+
+	for _, tt := range []struct {
+		host, port string
+		want       bool
+	}{
+		{"example.com", "", true},
+		{"EXAMPLE.com", "1965", true},
+		{"example.com", "1967", false},
+		{"sub.example.com", "", false},
+		{"sub.example.org", "", true},
+		{"example.org", "", false},
+		{"anything.test", "1966", true},
+		{"capsule.net", "7000", true},
+	} {
+		if got := fp.allowedHost(tt.host, tt.port); got != tt.want {
+			t.Fatalf("%s:%s: wanted %v, got: %v", tt.host, tt.port, tt.want, got)
+		}
+	}
+}
+
+func TestForwardProxyClients(t *testing.T) {
+	addr := originServer(t, "hello")
+	allowed := newTestClientCert(t)
+
+	fp := &ForwardProxy{
+		Hosts:   []string{"*:*"},
+		Clients: []string{strings.ToUpper(gemini.Fingerprint(allowed))},
+	}
+	if err := fp.load(gemini.NewKnownHosts(), 1965); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		cert   *x509.Certificate
+		status int
+	}{
+		{name: "no certificate", status: gemini.StatusClientCertificateRequired},
+		{name: "unknown certificate", cert: newTestClientCert(t), status: gemini.StatusCertificateNotAuthorised},
+		{name: "allowed certificate", cert: allowed, status: gemini.StatusSuccess},
+	} {
+		u, _ := url.Parse("gemini://" + addr + "/")
+		rw := new(geminitest.ResponseRecorder)
+		fp.HandleGemini(rw, &gemini.Request{URL: u, Cert: tt.cert})
+
+		if rw.StatusCode != tt.status {
+			t.Fatalf("%s: wanted status code %d, got: %d %s", tt.name, tt.status, rw.StatusCode, rw.Meta)
+		}
+	}
+}
+
+func TestForwardProxyMaxBodySize(t *testing.T) {
+	addr := originServer(t, strings.Repeat("a", 100))
+
+	fp := &ForwardProxy{Hosts: []string{"*:*"}, MaxBodySize: 10}
+	if err := fp.load(gemini.NewKnownHosts(), 1965); err != nil {
+		t.Fatal(err)
+	}
+
+	aborted := false
+	u, _ := url.Parse("gemini://" + addr + "/")
+	rw := new(geminitest.ResponseRecorder)
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				if p != gemini.ErrAbortHandler {
+					panic(p)
+				}
+				aborted = true
+			}
+		}()
+		fp.HandleGemini(rw, &gemini.Request{URL: u})
+	}()
+
+	if !aborted {
+		t.Fatal("wanted the oversized response to be aborted")
+	}
+	if rw.Body.Len() != 10 {
+		t.Fatalf("wanted 10 bytes to be passed on, got: %d", rw.Body.Len())
+	}
+}
+
+func TestRouteRefusesOtherSchemes(t *testing.T) {
+	rh := &Rhea{cfg: Config{Sites: []Site{{Domain: "example.com"}}}}
+
+	u, _ := url.Parse("https://example.com/")
+	rw := new(geminitest.ResponseRecorder)
+	rh.route(rw, &gemini.Request{URL: u})
+
+	if rw.StatusCode != gemini.StatusProxyRequestRefused {
+		t.Fatalf("wanted status code %d, got: %d %s", gemini.StatusProxyRequestRefused, rw.StatusCode, rw.Meta)
+	}
+}
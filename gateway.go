@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/gemtext"
+	"inet.af/netaddr"
+	"within.website/ln"
+)
+
+// WebGateway makes the sites reachable over HTTP too, for people without a
+// gemini client. Requests are routed to sites by their Host header and
+// text/gemini responses are rendered as HTML.
+type WebGateway struct {
+	// Stylesheet is the URL of the stylesheet of rendered pages. If empty, a
+	// small built-in style is used.
+	Stylesheet string `json:"stylesheet"`
+
+	// TLSPort serves the gateway over HTTPS as well, with the certificates
+	// of the sites. If zero, the gateway is only served on the HTTP port.
+	TLSPort uint16 `json:"tls_port"`
+}
+
+// gatewayInputField is the name of the form field that input asked for by
+// a 1x response is sent in.
+const gatewayInputField = "input"
+
+// defaultGatewayStyle is used when no stylesheet is configured.
+const defaultGatewayStyle = `body{max-width:40em;margin:0 auto;padding:1em;font-family:sans-serif;line-height:1.5}` +
+	`pre{overflow-x:auto;padding:.5em;background:#f4f4f4}` +
+	`blockquote{border-left:3px solid #ccc;margin-left:0;padding-left:1em}` +
+	`ul.links{list-style:none;padding-left:0}ul.links li::before{content:"⇒ "}` +
+	`@media (prefers-color-scheme:dark){body{background:#111;color:#ddd}a{color:#8cf}pre{background:#222}}`
+
+// webGateway serves requests for sites over HTTP. Requests for other hosts,
+// such as the metrics endpoint, go to next.
+func (rh *Rhea) webGateway(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !rh.hasSite(host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		u := &url.URL{
+			Scheme:   "gemini",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: gatewayQuery(r.URL),
+		}
+		if len(u.String()) > gemini.MaxRequestLength {
+			http.Error(w, "URL too long", http.StatusRequestURITooLong)
+			return
+		}
+
+		req := &gemini.Request{URL: u}
+		if addr, err := netaddr.ParseIPPort(r.RemoteAddr); err == nil {
+			req.RemoteAddr = addr
+		}
+		// Gemini clients are filtered by the listener, which the gateway
+		// doesn't go through.
+		if !rh.allowedIP(req.RemoteAddr.IP()) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		req = req.WithContext(r.Context())
+
+		gw := &gatewayWriter{w: w, u: u, stylesheet: rh.cfg.WebGateway.Stylesheet}
+		defer func() {
+			if p := recover(); p != nil {
+				if p != gemini.ErrAbortHandler {
+					ln.Error(r.Context(), fmt.Errorf("web gateway: panic serving %s: %v", u, p))
+				}
+				if gw.status == 0 {
+					gw.Status(gemini.StatusTemporaryFailure, "internal server error")
+					return
+				}
+				// The client must not take a cut off page for a whole one.
+				panic(http.ErrAbortHandler)
+			}
+			gw.finish()
+		}()
+
+		rh.HandleGemini(gw, req)
+	})
+}
+
+// hasSite reports whether a site is configured for domain.
+func (rh *Rhea) hasSite(domain string) bool {
+	for _, site := range rh.cfg.Sites {
+		if site.Domain == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayTLSConfig serves the gateway with the certificates of the sites.
+// Browsers don't have gemini client certificates, so none are asked for.
+func (rh *Rhea) gatewayTLSConfig() *tls.Config {
+	cfg := rh.tlsConfig()
+	cfg.GetConfigForClient = nil
+	return cfg
+}
+
+// gatewayQuery returns the gemini query of a gateway request. Input sent
+// with the form of a 1x response is escaped the way gemini clients do it;
+// any other query is passed on as it is.
+func gatewayQuery(u *url.URL) string {
+	q := u.Query()
+	if len(q) == 1 && len(q[gatewayInputField]) == 1 {
+		return strings.ReplaceAll(url.QueryEscape(q.Get(gatewayInputField)), "+", "%20")
+	}
+	return u.RawQuery
+}
+
+// httpStatus maps gemini failure statuses to HTTP ones.
+func httpStatus(status int) int {
+	switch status {
+	case gemini.StatusSlowDown:
+		return http.StatusTooManyRequests
+	case gemini.StatusCGIError, gemini.StatusProxyError:
+		return http.StatusBadGateway
+	case gemini.StatusNotFound:
+		return http.StatusNotFound
+	case gemini.StatusGone:
+		return http.StatusGone
+	case gemini.StatusProxyRequestRefused:
+		return http.StatusMisdirectedRequest
+	case gemini.StatusBadRequest:
+		return http.StatusBadRequest
+	case gemini.StatusClientCertificateRequired:
+		return http.StatusUnauthorized
+	case gemini.StatusCertificateNotAuthorised, gemini.StatusCertificateNotValid:
+		return http.StatusForbidden
+	}
+
+	switch status / 10 {
+	case gemini.StatusTemporaryFailure / 10:
+		return http.StatusServiceUnavailable
+	case gemini.StatusPermanentFailure / 10:
+		return http.StatusInternalServerError
+	case gemini.StatusClientCertificateRequired / 10:
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// gatewayWriter turns a gemini response into an HTTP one.
+type gatewayWriter struct {
+	w          http.ResponseWriter
+	u          *url.URL
+	stylesheet string
+
+	status int
+	body   io.Writer
+	html   *htmlRenderer
+}
+
+func (gw *gatewayWriter) Status(status int, meta string) {
+	if gw.status != 0 {
+		panic("Status called twice")
+	}
+	gw.status = status
+	gw.body = io.Discard
+
+	switch status / 10 {
+	case gemini.StatusInput / 10:
+		inputType := "text"
+		if status == gemini.StatusSensitiveInput {
+			inputType = "password"
+		}
+		p := gw.page(http.StatusOK, "Input requested", "")
+		fmt.Fprintf(gw.w, "<form method=\"get\">\n<p><label for=\"%[1]s\">%[2]s</label></p>\n<p><input id=\"%[1]s\" name=\"%[1]s\" type=\"%[3]s\" required autofocus> <button type=\"submit\">Send</button></p>\n</form>\n",
+			gatewayInputField, html.EscapeString(meta), inputType)
+		p.Close()
+
+	case gemini.StatusSuccess / 10:
+		mt, params, err := mime.ParseMediaType(meta)
+		if err != nil || mt != "text/gemini" {
+			h := gw.w.Header()
+			h.Set("Content-Type", passthroughType(meta, mt, params, err))
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+			gw.w.WriteHeader(http.StatusOK)
+			gw.body = gw.w
+			return
+		}
+		gw.html = gw.page(http.StatusOK, gw.u.Host+gw.u.Path, params["lang"])
+		gw.body = gw.html
+
+	case gemini.StatusRedirect / 10:
+		code := http.StatusFound
+		if status == gemini.StatusRedirectPermanent {
+			code = http.StatusMovedPermanently
+		}
+		href, ok := gatewayHref(gw.u, meta)
+		if !ok {
+			code = http.StatusBadGateway
+			p := gw.page(code, http.StatusText(code), "")
+			fmt.Fprintf(gw.w, "<h1>%s</h1>\n<p>The page redirects to a link that can't be followed from the web.</p>\n", html.EscapeString(http.StatusText(code)))
+			p.Close()
+			return
+		}
+		gw.w.Header().Set("Location", href)
+		gw.w.WriteHeader(code)
+
+	default:
+		code := httpStatus(status)
+		if status == gemini.StatusSlowDown {
+			gw.w.Header().Set("Retry-After", meta)
+			meta = "Too many requests, try again in " + meta + " seconds."
+		}
+		if status/10 == gemini.StatusClientCertificateRequired/10 {
+			meta += " (this page needs a gemini client certificate, which web browsers can't send)"
+		}
+		p := gw.page(code, http.StatusText(code), "")
+		fmt.Fprintf(gw.w, "<h1>%s</h1>\n<p>%s</p>\n", html.EscapeString(http.StatusText(code)), html.EscapeString(meta))
+		p.Close()
+	}
+}
+
+// passthroughType is the Content-Type a response that isn't gemtext is
+// served with. Capsules could run scripts on the gateway's origin with
+// HTML or SVG, so those are shown as plain text, and types that don't
+// parse are served as opaque bytes.
+func passthroughType(meta, mt string, params map[string]string, err error) string {
+	if err != nil {
+		return "application/octet-stream"
+	}
+	switch mt {
+	case "text/html", "application/xhtml+xml", "image/svg+xml":
+		if cs, ok := params["charset"]; ok {
+			return mime.FormatMediaType("text/plain", map[string]string{"charset": cs})
+		}
+		return "text/plain"
+	}
+	return meta
+}
+
+func (gw *gatewayWriter) Write(data []byte) (int, error) {
+	if gw.body == nil {
+		return 0, fmt.Errorf("web gateway: body written before status")
+	}
+	return gw.body.Write(data)
+}
+
+// page starts an HTML page. The returned renderer takes gemtext; HTML of
+// the gateway's own goes straight to gw.w.
+func (gw *gatewayWriter) page(code int, title, lang string) *htmlRenderer {
+	gw.w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	gw.w.WriteHeader(code)
+	return newHTMLRenderer(gw.w, gw.u, title, lang, gw.stylesheet)
+}
+
+// finish ends the response once the handler is done.
+func (gw *gatewayWriter) finish() {
+	if gw.status == 0 {
+		gw.Status(gemini.StatusTemporaryFailure, "no response")
+	}
+	if gw.html != nil {
+		gw.html.Close()
+	}
+}
+
+// gatewaySchemes are the schemes of links that are safe to put on a page
+// of the web gateway. Links with other schemes, such as javascript:, would
+// run on the origin of the site and are shown as text instead.
+var gatewaySchemes = map[string]bool{
+	"gemini": true,
+	"gopher": true,
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// gatewayHref turns a link on a gemini page into one that works on the web
+// gateway. Links to the same site are made relative to it; links elsewhere
+// are left alone. It reports false for links that must not be followed.
+func gatewayHref(base *url.URL, link string) (string, bool) {
+	u, err := base.Parse(link)
+	if err != nil || !gatewaySchemes[u.Scheme] {
+		return "", false
+	}
+	if u.Scheme != "gemini" || !sameHost(u.Host, base.Host) {
+		return u.String(), true
+	}
+
+	result := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery, Fragment: u.Fragment}
+	if result.Path == "" {
+		result.Path = "/"
+	}
+	return result.String(), true
+}
+
+// maxGatewayLineLength is the length of the longest gemtext line that is
+// buffered to be rendered. Longer lines are streamed as text.
+const maxGatewayLineLength = 64 << 10
+
+// htmlRenderer renders a text/gemini body as HTML as it is written. Close
+// must be called at the end to finish the page.
+type htmlRenderer struct {
+	w    io.Writer
+	base *url.URL
+
+	line   []byte
+	long   string // closing tag of a long line that is being streamed
+	parser gemtext.Parser
+	block  string // the list or quote lines are being added to
+}
+
+func newHTMLRenderer(w io.Writer, base *url.URL, title, lang, stylesheet string) *htmlRenderer {
+	hr := &htmlRenderer{w: w, base: base}
+
+	io.WriteString(w, "<!DOCTYPE html>\n<html")
+	if lang != "" {
+		fmt.Fprintf(w, " lang=\"%s\"", html.EscapeString(lang))
+	}
+	fmt.Fprintf(w, ">\n<head>\n<meta charset=\"utf-8\">\n<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n<title>%s</title>\n", html.EscapeString(title))
+	if stylesheet != "" {
+		fmt.Fprintf(w, "<link rel=\"stylesheet\" href=\"%s\">\n", html.EscapeString(stylesheet))
+	} else {
+		fmt.Fprintf(w, "<style>%s</style>\n", defaultGatewayStyle)
+	}
+	io.WriteString(w, "</head>\n<body>\n<main>\n")
+
+	return hr
+}
+
+func (hr *htmlRenderer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+
+		if hr.long != "" {
+			if i < 0 {
+				return n, hr.text(p)
+			}
+			hr.text(p[:i])
+			io.WriteString(hr.w, hr.long)
+			hr.long = ""
+			p = p[i+1:]
+			continue
+		}
+
+		if i < 0 {
+			hr.line = append(hr.line, p...)
+			if len(hr.line) > maxGatewayLineLength {
+				hr.startLong()
+			}
+			return n, nil
+		}
+
+		hr.line = append(hr.line, p[:i]...)
+		hr.renderLine(string(hr.line))
+		hr.line = hr.line[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// startLong starts streaming a line too long to buffer as text.
+func (hr *htmlRenderer) startLong() {
+	if hr.parser.Preformatted() {
+		hr.long = "\n"
+	} else {
+		hr.setBlock("")
+		io.WriteString(hr.w, "<p>")
+		hr.long = "</p>\n"
+	}
+	hr.text(hr.line)
+	hr.line = hr.line[:0]
+}
+
+func (hr *htmlRenderer) text(p []byte) error {
+	_, err := io.WriteString(hr.w, html.EscapeString(strings.TrimSuffix(string(p), "\r")))
+	return err
+}
+
+// Close renders the last line and finishes the page.
+func (hr *htmlRenderer) Close() error {
+	if hr.long != "" {
+		io.WriteString(hr.w, hr.long)
+		hr.long = ""
+	} else if len(hr.line) != 0 {
+		hr.renderLine(string(hr.line))
+		hr.line = hr.line[:0]
+	}
+	if hr.parser.Preformatted() {
+		io.WriteString(hr.w, "</pre>\n")
+	}
+	hr.setBlock("")
+	_, err := io.WriteString(hr.w, "</main>\n</body>\n</html>\n")
+	return err
+}
+
+// setBlock closes the list or quote being written, if it isn't kind, and
+// opens one of kind.
+func (hr *htmlRenderer) setBlock(kind string) {
+	if hr.block == kind {
+		return
+	}
+
+	switch hr.block {
+	case "links", "list":
+		io.WriteString(hr.w, "</ul>\n")
+	case "quote":
+		io.WriteString(hr.w, "</blockquote>\n")
+	}
+	switch kind {
+	case "links":
+		io.WriteString(hr.w, "<ul class=\"links\">\n")
+	case "list":
+		io.WriteString(hr.w, "<ul>\n")
+	case "quote":
+		io.WriteString(hr.w, "<blockquote>\n")
+	}
+	hr.block = kind
+}
+
+func (hr *htmlRenderer) renderLine(line string) {
+	esc := html.EscapeString
+
+	switch l := hr.parser.ParseLine(strings.TrimSuffix(line, "\r")).(type) {
+	case gemtext.PreformatToggle:
+		if !hr.parser.Preformatted() {
+			io.WriteString(hr.w, "</pre>\n")
+			return
+		}
+		hr.setBlock("")
+		if l.Alt != "" {
+			fmt.Fprintf(hr.w, "<pre aria-label=\"%s\">", esc(l.Alt))
+		} else {
+			io.WriteString(hr.w, "<pre>")
+		}
+
+	case gemtext.Preformatted:
+		io.WriteString(hr.w, esc(string(l))+"\n")
+
+	case gemtext.Link:
+		label := l.Label
+		if label == "" {
+			label = l.URL
+		}
+		hr.setBlock("links")
+		href, ok := gatewayHref(hr.base, l.URL)
+		if !ok {
+			fmt.Fprintf(hr.w, "<li>%s</li>\n", esc(label))
+			return
+		}
+		fmt.Fprintf(hr.w, "<li><a href=\"%s\">%s</a></li>\n", esc(href), esc(label))
+
+	case gemtext.Heading:
+		hr.setBlock("")
+		fmt.Fprintf(hr.w, "<h%[1]d>%[2]s</h%[1]d>\n", l.Level, esc(l.Text))
+
+	case gemtext.ListItem:
+		hr.setBlock("list")
+		fmt.Fprintf(hr.w, "<li>%s</li>\n", esc(strings.TrimSpace(string(l))))
+
+	case gemtext.Quote:
+		hr.setBlock("quote")
+		fmt.Fprintf(hr.w, "<p>%s</p>\n", esc(strings.TrimSpace(string(l))))
+
+	case gemtext.Text:
+		hr.setBlock("")
+		if strings.TrimSpace(string(l)) != "" {
+			fmt.Fprintf(hr.w, "<p>%s</p>\n", esc(string(l)))
+		}
+	}
+}
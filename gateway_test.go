@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTMLRenderer(t *testing.T) {
+	base, _ := url.Parse("gemini://example.com/dir/page.gmi")
+	body := "# Title\n" +
+		"Some <text> & more\r\n" +
+		"\n" +
+		"=> gemini://example.com/about About\n" +
+		"=> other.gmi\n" +
+		"=> gemini://elsewhere.test/ Elsewhere\n" +
+		"* one\n" +
+		"* two\n" +
+		"> quoted\n" +
+		"```ascii art\n" +
+		"=> not a link\n" +
+		"```\n" +
+		"## Sub\n" +
+		"### Subsub\n" +
+		"last line"
+
+	var buf bytes.Buffer
+	hr := newHTMLRenderer(&buf, base, "title", "en", "/style.css")
+	// Writing a byte at a time splits every line across writes.
+	for i := 0; i < len(body); i++ {
+		io.WriteString(hr, body[i:i+1])
+	}
+	hr.Close()
+
+	got := buf.String()
+	for _, want := range []string{
+		`<html lang="en">`,
+		`<link rel="stylesheet" href="/style.css">`,
+		"<h1>Title</h1>\n<p>Some &lt;text&gt; &amp; more</p>\n",
+		"<ul class=\"links\">\n<li><a href=\"/about\">About</a></li>\n<li><a href=\"/dir/other.gmi\">other.gmi</a></li>\n<li><a href=\"gemini://elsewhere.test/\">Elsewhere</a></li>\n</ul>\n",
+		"<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n<blockquote>\n<p>quoted</p>\n</blockquote>\n",
+		"<pre aria-label=\"ascii art\">=&gt; not a link\n</pre>\n",
+		"<h2>Sub</h2>\n<h3>Subsub</h3>\n<p>last line</p>\n</main>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("wanted page to contain %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestHTMLRendererUnsafeLinks(t *testing.T) {
+	base, _ := url.Parse("gemini://example.com/")
+	body := "=> javascript:alert(1) x\n" +
+		"=> JavaScript:alert(1)\n" +
+		"=> data:text/html,<script>alert(1)</script> y\n" +
+		"=> vbscript:msgbox z\n" +
+		"=> https://example.org/ web\n" +
+		"=> mailto:cadey@example.com mail\n" +
+		"=> gopher://example.org/ hole\n"
+
+	var buf bytes.Buffer
+	hr := newHTMLRenderer(&buf, base, "title", "", "")
+	io.WriteString(hr, body)
+	hr.Close()
+
+	got := buf.String()
+	for _, want := range []string{
+		"<li>x</li>\n<li>JavaScript:alert(1)</li>\n<li>y</li>\n<li>z</li>\n",
+		`<a href="https://example.org/">web</a>`,
+		`<a href="mailto:cadey@example.com">mail</a>`,
+		`<a href="gopher://example.org/">hole</a>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("wanted page to contain %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(strings.ToLower(got), "href=\"javascript") || strings.Contains(got, "href=\"data") || strings.Contains(got, "href=\"vbscript") {
+		t.Fatalf("wanted no script links, got:\n%s", got)
+	}
+}
+
+func TestHTMLRendererLongLine(t *testing.T) {
+	base, _ := url.Parse("gemini://example.com/")
+	long := strings.Repeat("<", maxGatewayLineLength+10)
+
+	var buf bytes.Buffer
+	hr := newHTMLRenderer(&buf, base, "title", "", "")
+	io.WriteString(hr, long)
+	io.WriteString(hr, long+"\n# After\n")
+	hr.Close()
+
+	want := "<p>" + strings.Repeat("&lt;", 2*len(long)) + "</p>\n<h1>After</h1>\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Fatal("wanted the long line to be streamed as a paragraph")
+	}
+}
+
+func TestWebGateway(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/gemini; lang=de")
+			io.WriteString(w, "# Hallo\n=> /search Suche\n")
+		case "/search":
+			if input, _ := url.QueryUnescape(r.Header.Get(headerGeminiInput)); input != "" {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "searched for "+input)
+				return
+			}
+			w.Header().Set(headerGeminiStatus, "10")
+			w.Header().Set(headerGeminiMeta, "Search <terms>")
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, "<script>alert(1)</script>")
+		case "/old":
+			w.Header().Set(headerGeminiStatus, "31")
+			w.Header().Set(headerGeminiMeta, "gemini://example.com/new")
+		case "/evil":
+			w.Header().Set(headerGeminiStatus, "30")
+			w.Header().Set(headerGeminiMeta, "javascript:alert(1)")
+		case "/slow":
+			w.Header().Set(headerGeminiStatus, "44")
+			w.Header().Set(headerGeminiMeta, "30")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	rh, err := New(Config{
+		Sites:      []Site{{Domain: "example.com", HTTPBackend: &HTTPBackend{URL: backend.URL}}},
+		WebGateway: &WebGateway{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rh.stop()
+	h := httpMux(rh)
+
+	get := func(host, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("example.com", "/")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("wanted an HTML page, got: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `<html lang="de">`) || !strings.Contains(body, `<a href="/search">Suche</a>`) {
+		t.Fatalf("wanted the gemtext to be rendered, got:\n%s", body)
+	}
+
+	rec = get("example.com:8080", "/search")
+	if body := rec.Body.String(); rec.Code != http.StatusOK || !strings.Contains(body, `<label for="input">Search &lt;terms&gt;</label>`) {
+		t.Fatalf("wanted an input form, got: %d\n%s", rec.Code, body)
+	}
+
+	rec = get("example.com", "/search?input=gemini+protocol")
+	if rec.Header().Get("Content-Type") != "text/plain" || rec.Body.String() != "searched for gemini protocol" {
+		t.Fatalf("wanted the input to be passed on, got: %s %q", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" || rec.Header().Get("Content-Security-Policy") != "default-src 'none'; sandbox" {
+		t.Fatalf("wanted the passed on response to be locked down, got: %v", rec.Header())
+	}
+
+	rec = get("example.com", "/page.html")
+	if rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("wanted HTML from the capsule to be served as plain text, got: %s", rec.Header().Get("Content-Type"))
+	}
+
+	rec = get("example.com", "/old")
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/new" {
+		t.Fatalf("wanted a redirect to /new, got: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = get("example.com", "/evil")
+	if rec.Code != http.StatusBadGateway || rec.Header().Get("Location") != "" {
+		t.Fatalf("wanted the redirect to be refused, got: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = get("example.com", "/slow")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" {
+		t.Fatalf("wanted status code %d, got: %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	rec = get("example.com", "/missing")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("wanted status code %d, got: %d", http.StatusNotFound, rec.Code)
+	}
+
+	// Other hosts still get the metrics and admin endpoints.
+	rec = get("localhost", "/metrics")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# HELP") {
+		t.Fatalf("wanted the metrics, got: %d", rec.Code)
+	}
+}
+
+func TestWebGatewayIPRules(t *testing.T) {
+	rh, err := New(Config{
+		Sites:      []Site{{Domain: "example.com", Files: &FileServer{Root: t.TempDir(), AutoIndex: true}}},
+		WebGateway: &WebGateway{},
+		IPRules:    &IPRules{Deny: []string{"192.0.2.0/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rh.stop()
+	h := httpMux(rh)
+
+	for _, tt := range []struct {
+		addr string
+		want int
+	}{
+		{addr: "192.0.2.1:1234", want: http.StatusForbidden},
+		{addr: "198.51.100.1:1234", want: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "example.com"
+		req.RemoteAddr = tt.addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Fatalf("%s: wanted status code %d, got: %d", tt.addr, tt.want, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package gemini
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+	"within.website/ln"
+)
+
+var banCount = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gemini_abuse_bans_total",
+	Help: "The number of clients banned for making too many failing requests",
+})
+
+// Ban is a range of client addresses that is not allowed to connect until
+// Expires. IPv4 bans are for a single address.
+type Ban struct {
+	Prefix  netaddr.IPPrefix
+	Expires time.Time
+}
+
+// String returns the banned address, or the banned range if it is more
+// than one address.
+func (b Ban) String() string {
+	if b.Prefix.IsSingleIP() {
+		return b.Prefix.IP().String()
+	}
+	return b.Prefix.String()
+}
+
+// BanList is a set of temporarily banned client addresses. It is safe for
+// concurrent use. When it is backed by a file, every change is written back
+// to that file so bans survive restarts.
+//
+// IPv6 addresses are banned by prefix, since a single client often
+// controls a whole /64 and could otherwise move on to the next address.
+//
+// The file format has one ban per line:
+//
+//	<ip or prefix> <expiry as RFC 3339>
+type BanList struct {
+	// IPv6Prefix is the prefix length IPv6 addresses are banned by. Zero
+	// means 64.
+	IPv6Prefix uint8
+
+	path string
+
+	mu   sync.RWMutex
+	bans map[netaddr.IPPrefix]time.Time
+}
+
+// NewBanList creates an empty in-memory ban list.
+func NewBanList() *BanList {
+	return &BanList{bans: map[netaddr.IPPrefix]time.Time{}}
+}
+
+// group returns the range of addresses that is banned along with ip.
+func (bl *BanList) group(ip netaddr.IP) netaddr.IPPrefix {
+	ip = ip.Unmap()
+	bits := ip.BitLen()
+	if ip.Is6() {
+		bits = bl.IPv6Prefix
+		if bits == 0 {
+			bits = 64
+		}
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return netaddr.IPPrefixFrom(ip, ip.BitLen())
+	}
+	return p
+}
+
+// LoadBanList loads a ban list from the file at path, skipping bans that
+// have expired. The file is created on the first change if it doesn't
+// exist yet.
+func LoadBanList(path string) (*BanList, error) {
+	bl := NewBanList()
+	bl.path = path
+
+	fin, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	now := time.Now()
+	sc := bufio.NewScanner(fin)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: wanted 2 fields, got %d", path, lineno, len(fields))
+		}
+		var prefix netaddr.IPPrefix
+		if strings.Contains(fields[0], "/") {
+			prefix, err = netaddr.ParseIPPrefix(fields[0])
+			prefix = prefix.Masked()
+		} else {
+			var ip netaddr.IP
+			ip, err = netaddr.ParseIP(fields[0])
+			prefix = bl.group(ip)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		expires, err := time.Parse(time.RFC3339, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid expiry: %v", path, lineno, err)
+		}
+
+		if expires.After(now) {
+			bl.bans[prefix] = expires
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return bl, nil
+}
+
+// Banned reports whether ip is currently banned.
+func (bl *BanList) Banned(ip netaddr.IP) bool {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	expires, ok := bl.bans[bl.group(ip)]
+	return ok && time.Now().Before(expires)
+}
+
+// Allowed is the opposite of Banned. It is useful with FilterListener.
+func (bl *BanList) Allowed(ip netaddr.IP) bool {
+	return !bl.Banned(ip)
+}
+
+// Ban bans ip, along with the rest of its IPv6 prefix, until the given
+// time, replacing any existing ban.
+func (bl *BanList) Ban(ip netaddr.IP, until time.Time) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.bans[bl.group(ip)] = until
+	return bl.saveLocked()
+}
+
+// Unban lifts the ban on ip and the rest of its IPv6 prefix, if any.
+func (bl *BanList) Unban(ip netaddr.IP) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	delete(bl.bans, bl.group(ip))
+	return bl.saveLocked()
+}
+
+// Bans returns all bans that haven't expired yet, sorted by address.
+func (bl *BanList) Bans() []Ban {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	now := time.Now()
+	result := make([]Ban, 0, len(bl.bans))
+	for prefix, expires := range bl.bans {
+		if expires.After(now) {
+			result = append(result, Ban{Prefix: prefix, Expires: expires})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Prefix.IP().Less(result[j].Prefix.IP()) })
+	return result
+}
+
+// saveLocked drops expired bans and writes the list back to its file, if
+// it has one. bl.mu must be held.
+func (bl *BanList) saveLocked() error {
+	now := time.Now()
+	for prefix, expires := range bl.bans {
+		if !expires.After(now) {
+			delete(bl.bans, prefix)
+		}
+	}
+
+	if bl.path == "" {
+		return nil
+	}
+
+	bans := make([]Ban, 0, len(bl.bans))
+	for prefix, expires := range bl.bans {
+		bans = append(bans, Ban{Prefix: prefix, Expires: expires})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Prefix.IP().Less(bans[j].Prefix.IP()) })
+
+	var sb strings.Builder
+	for _, ban := range bans {
+		fmt.Fprintf(&sb, "%s %s\n", ban, ban.Expires.UTC().Format(time.RFC3339))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(bl.path), filepath.Base(bl.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), bl.path)
+}
+
+// DefaultMaxAbuseClients is the number of clients an AbuseDetector keeps
+// track of when MaxClients is not set.
+const DefaultMaxAbuseClients = 10000
+
+// AbuseDetector bans clients that get too many error responses in a short
+// time, which is what scanners probing for well known paths look like.
+type AbuseDetector struct {
+	// Bans is where offending clients are banned.
+	Bans *BanList
+
+	// MaxErrors is the number of error responses a client may get within
+	// Window before it is banned.
+	MaxErrors int
+
+	// Window is the length of the sliding window errors are counted in.
+	Window time.Duration
+
+	// BanDuration is how long offending clients are banned for.
+	BanDuration time.Duration
+
+	// IsError decides which statuses count as errors. If nil, all 5x
+	// statuses do.
+	IsError func(status int) bool
+
+	// MaxClients is the number of clients to keep track of. Zero means
+	// DefaultMaxAbuseClients.
+	MaxClients int
+
+	mu      sync.Mutex
+	clients map[netaddr.IPPrefix]*list.Element
+	lru     list.List
+}
+
+// abuseClient is the error history of the addresses banned together.
+type abuseClient struct {
+	prefix netaddr.IPPrefix
+	errors []time.Time
+}
+
+// Observe records a response with the given status sent to ip and bans ip
+// if it has now had too many errors. It reports whether ip was banned.
+func (ad *AbuseDetector) Observe(ip netaddr.IP, status int) (bool, error) {
+	return ad.observeAt(ip.Unmap(), status, time.Now())
+}
+
+func (ad *AbuseDetector) observeAt(ip netaddr.IP, status int, now time.Time) (bool, error) {
+	isError := ad.IsError
+	if isError == nil {
+		isError = func(status int) bool { return status/10 == StatusPermanentFailure/10 }
+	}
+	if !isError(status) {
+		return false, nil
+	}
+
+	// Errors are counted for everyone a ban would hit, so that spreading
+	// them over a prefix doesn't help.
+	prefix := ad.Bans.group(ip)
+
+	ad.mu.Lock()
+	if ad.clients == nil {
+		ad.clients = map[netaddr.IPPrefix]*list.Element{}
+	}
+
+	var c *abuseClient
+	if e, ok := ad.clients[prefix]; ok {
+		ad.lru.MoveToFront(e)
+		c = e.Value.(*abuseClient)
+	} else {
+		c = &abuseClient{prefix: prefix}
+		ad.clients[prefix] = ad.lru.PushFront(c)
+		ad.evictLocked()
+	}
+
+	// Only errors inside the window count.
+	cutoff := now.Add(-ad.Window)
+	kept := c.errors[:0]
+	for _, t := range c.errors {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	c.errors = append(kept, now)
+
+	ban := len(c.errors) > ad.MaxErrors
+	if ban {
+		ad.lru.Remove(ad.clients[prefix])
+		delete(ad.clients, prefix)
+	}
+	ad.mu.Unlock()
+
+	if !ban {
+		return false, nil
+	}
+
+	banCount.Inc()
+	return true, ad.Bans.Ban(ip, now.Add(ad.BanDuration))
+}
+
+// evictLocked forgets the least recently seen clients until at most
+// MaxClients are left. ad.mu must be held.
+func (ad *AbuseDetector) evictLocked() {
+	max := ad.MaxClients
+	if max <= 0 {
+		max = DefaultMaxAbuseClients
+	}
+
+	for ad.lru.Len() > max {
+		e := ad.lru.Back()
+		ad.lru.Remove(e)
+		delete(ad.clients, e.Value.(*abuseClient).prefix)
+	}
+}
+
+// DetectAbuse wraps a handler so that the responses it sends are observed
+// by ad. Requests from banned clients that got past the listener, such as
+// ones made on a connection opened before the ban, are answered with
+// StatusProxyRequestRefused.
+func DetectAbuse(h Handler, ad *AbuseDetector) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		ip := r.RemoteAddr.IP()
+		if ip.IsZero() {
+			h.HandleGemini(w, r)
+			return
+		}
+
+		if ad.Bans.Banned(ip) {
+			w.Status(StatusProxyRequestRefused, "banned")
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		h.HandleGemini(sw, r)
+
+		banned, err := ad.Observe(ip, sw.status)
+		if banned {
+			ln.Log(r.Context(), ln.Info("banned %s for too many failing requests", ip))
+		}
+		if err != nil {
+			ln.Error(r.Context(), err, ln.Action("saving ban list"))
+		}
+	})
+}
+
+// statusWriter remembers the status sent through a ResponseWriter.
+type statusWriter struct {
+	ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) Status(status int, meta string) {
+	sw.status = status
+	sw.ResponseWriter.Status(status, meta)
+}
@@ -0,0 +1,165 @@
+package gemini
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini/geminitest"
+	"inet.af/netaddr"
+)
+
+func TestAbuseDetector(t *testing.T) {
+	ad := &AbuseDetector{
+		Bans:        NewBanList(),
+		MaxErrors:   2,
+		Window:      time.Minute,
+		BanDuration: time.Hour,
+	}
+	ip := netaddr.MustParseIP("192.0.2.1")
+	now := time.Now()
+
+	observe := func(status int, at time.Time) bool {
+		t.Helper()
+		banned, err := ad.observeAt(ip, status, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return banned
+	}
+
+	if observe(StatusSuccess, now) || observe(StatusSuccess, now) || observe(StatusSuccess, now) {
+		t.Fatal("successful responses got the client banned")
+	}
+
+	observe(StatusNotFound, now.Add(-2*time.Minute))
+	observe(StatusNotFound, now)
+	if observe(StatusNotFound, now) {
+		t.Fatal("errors outside the window were counted")
+	}
+
+	if !observe(StatusBadRequest, now) {
+		t.Fatal("client was not banned after too many errors")
+	}
+	if !ad.Bans.Banned(ip) {
+		t.Fatal("ban was not recorded")
+	}
+}
+
+func TestDetectAbuse(t *testing.T) {
+	ad := &AbuseDetector{
+		Bans:        NewBanList(),
+		MaxErrors:   1,
+		Window:      time.Minute,
+		BanDuration: time.Hour,
+	}
+	h := DetectAbuse(NotFound(), ad)
+	u, _ := url.Parse("gemini://localhost/.env")
+	r := &Request{URL: u, RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:1965")}
+
+	for i := 0; i < 2; i++ {
+		rw := new(geminitest.ResponseRecorder)
+		h.HandleGemini(rw, r)
+		if rw.StatusCode != StatusNotFound {
+			t.Fatalf("request %d: wanted status code %d, got: %d", i, StatusNotFound, rw.StatusCode)
+		}
+	}
+
+	rw := new(geminitest.ResponseRecorder)
+	h.HandleGemini(rw, r)
+	if rw.StatusCode != StatusProxyRequestRefused {
+		t.Fatalf("wanted banned client to be refused, got: %d", rw.StatusCode)
+	}
+}
+
+func TestBanListFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans")
+
+	bl, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.Ban(netaddr.MustParseIP("192.0.2.1"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.Ban(netaddr.MustParseIP("2001:db8::1"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.Unban(netaddr.MustParseIP("2001:db8::1")); err != nil {
+		t.Fatal(err)
+	}
+
+	bl2, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bl2.Banned(netaddr.MustParseIP("::ffff:192.0.2.1")) {
+		t.Fatal("ban did not survive reloading")
+	}
+	if bl2.Banned(netaddr.MustParseIP("2001:db8::1")) {
+		t.Fatal("lifted ban came back after reloading")
+	}
+	if bans := bl2.Bans(); len(bans) != 1 {
+		t.Fatalf("wanted 1 ban, got: %v", bans)
+	}
+}
+
+func TestBanListIPv6Prefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans")
+
+	bl, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.Ban(netaddr.MustParseIP("2001:db8:1:2::1"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	bl2, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bl := range []*BanList{bl, bl2} {
+		if !bl.Banned(netaddr.MustParseIP("2001:db8:1:2:ffff::1")) {
+			t.Fatal("wanted the rest of the /64 to be banned")
+		}
+		if bl.Banned(netaddr.MustParseIP("2001:db8:1:3::1")) {
+			t.Fatal("wanted other prefixes not to be banned")
+		}
+	}
+	if bans := bl2.Bans(); len(bans) != 1 || bans[0].String() != "2001:db8:1:2::/64" {
+		t.Fatalf("wanted the /64 to be listed, got: %v", bans)
+	}
+
+	bl.IPv6Prefix = 48
+	if err := bl.Ban(netaddr.MustParseIP("2001:db8:2:3::1"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if !bl.Banned(netaddr.MustParseIP("2001:db8:2:ffff::1")) {
+		t.Fatal("wanted the rest of the /48 to be banned")
+	}
+}
+
+func TestAbuseDetectorIPv6Prefix(t *testing.T) {
+	ad := &AbuseDetector{
+		Bans:        NewBanList(),
+		MaxErrors:   2,
+		Window:      time.Minute,
+		BanDuration: time.Hour,
+	}
+	now := time.Now()
+
+	for i, addr := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"} {
+		banned, err := ad.observeAt(netaddr.MustParseIP(addr), StatusNotFound, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if banned != (i == 2) {
+			t.Fatalf("%s: wanted errors from the same /64 to add up, got banned: %v", addr, banned)
+		}
+	}
+	if !ad.Bans.Banned(netaddr.MustParseIP("2001:db8::ffff")) {
+		t.Fatal("wanted the /64 to be banned")
+	}
+}
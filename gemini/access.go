@@ -0,0 +1,139 @@
+package gemini
+
+import (
+	"crypto/x509"
+	"strings"
+	"sync"
+)
+
+// CertAuthorizer decides whether the owner of a client certificate may
+// access a resource. The certificate is given by its fingerprint, as
+// returned by Request.Fingerprint, and cert is nil when a proxy only
+// forwarded the fingerprint.
+type CertAuthorizer interface {
+	Authorized(fingerprint string, cert *x509.Certificate) bool
+}
+
+// CertAllowlist is a CertAuthorizer that allows certificates by their
+// SHA-256 fingerprint or by their subject name. Subject names match either
+// the certificate's common name or its whole distinguished name, such as
+// "CN=cadey,O=Within".
+//
+// Anybody can make a certificate with any subject, so subject names only
+// match certificates that were signed by one of the allowlist's roots. Client
+// certificates aren't checked against a CA during the handshake, so without
+// roots an allowlist only matches fingerprints.
+//
+// A CertAllowlist is safe for concurrent use and can be replaced while in
+// use, for example when reloading a configuration file.
+type CertAllowlist struct {
+	mu           sync.RWMutex
+	fingerprints map[string]bool
+	subjects     map[string]bool
+	roots        *x509.CertPool
+}
+
+// NewCertAllowlist creates an allowlist for the given fingerprints and
+// subject names. Subject names are checked for certificates signed by
+// roots.
+func NewCertAllowlist(fingerprints, subjects []string, roots *x509.CertPool) *CertAllowlist {
+	al := &CertAllowlist{}
+	al.Replace(fingerprints, subjects, roots)
+	return al
+}
+
+// Replace atomically replaces the contents of the allowlist.
+func (al *CertAllowlist) Replace(fingerprints, subjects []string, roots *x509.CertPool) {
+	fps := make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		fps[strings.ToLower(fp)] = true
+	}
+	subs := make(map[string]bool, len(subjects))
+	for _, sub := range subjects {
+		subs[sub] = true
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.fingerprints = fps
+	al.subjects = subs
+	al.roots = roots
+}
+
+// Authorized reports whether the certificate is on the allowlist. Without
+// cert, only its fingerprint can match.
+func (al *CertAllowlist) Authorized(fingerprint string, cert *x509.Certificate) bool {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+
+	if al.fingerprints[strings.ToLower(fingerprint)] {
+		return true
+	}
+	if cert == nil {
+		return false
+	}
+	if !al.subjects[cert.Subject.CommonName] && !al.subjects[cert.Subject.String()] {
+		return false
+	}
+	return al.signed(cert)
+}
+
+// signed reports whether cert is a client certificate signed by one of the
+// roots of the allowlist.
+func (al *CertAllowlist) signed(cert *x509.Certificate) bool {
+	if al.roots == nil {
+		return false
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     al.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// AccessRule protects every request path starting with Prefix.
+type AccessRule struct {
+	Prefix     string
+	Authorizer CertAuthorizer
+}
+
+// RestrictAccess wraps a handler so that requests under the prefixes of
+// the given rules need an authorized client certificate. When several rules
+// match a path, the one with the longest prefix applies.
+//
+// Requests without a certificate are answered with
+// StatusClientCertificateRequired and requests with a certificate that
+// isn't authorized are answered with StatusCertificateNotAuthorised.
+// Requests that don't match any rule are passed through untouched.
+//
+// Paths are cleaned before they are matched, so that "/a/../private/" is
+// protected the same way as "/private/" is. A path that only lacks the
+// trailing slash of a prefix, such as "/private", matches it too.
+func RestrictAccess(h Handler, rules ...AccessRule) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		p := cleanPath(r.URL.Path)
+
+		var rule *AccessRule
+		for i := range rules {
+			if !strings.HasPrefix(p, rules[i].Prefix) && p+"/" != rules[i].Prefix {
+				continue
+			}
+			if rule == nil || len(rules[i].Prefix) > len(rule.Prefix) {
+				rule = &rules[i]
+			}
+		}
+
+		fp := r.Fingerprint()
+		switch {
+		case rule == nil:
+		case fp == "":
+			w.Status(StatusClientCertificateRequired, "client certificate required")
+			return
+		case !rule.Authorizer.Authorized(fp, r.Cert):
+			w.Status(StatusCertificateNotAuthorised, "certificate not authorised")
+			return
+		}
+
+		h.HandleGemini(w, r)
+	})
+}
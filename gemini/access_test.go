@@ -0,0 +1,107 @@
+package gemini
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+func TestRestrictAccess(t *testing.T) {
+	now := time.Now()
+	alice := newTestCert(t, "alice", now.Add(-time.Hour), now.Add(time.Hour)).Leaf
+	bob := newTestCert(t, "bob", now.Add(-time.Hour), now.Add(time.Hour)).Leaf
+	carol := newTestCert(t, "carol", now.Add(-time.Hour), now.Add(time.Hour)).Leaf
+	ca := newTestCA(t)
+	signedBob := newSignedCert(t, "bob", &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	h := RestrictAccess(
+		HandlerFunc(func(w ResponseWriter, r *Request) {
+			w.Status(StatusSuccess, "text/plain")
+		}),
+		AccessRule{Prefix: "/private/", Authorizer: NewCertAllowlist([]string{Fingerprint(alice)}, []string{"bob"}, roots)},
+		AccessRule{Prefix: "/private/alice/", Authorizer: NewCertAllowlist([]string{Fingerprint(alice)}, nil, nil)},
+	)
+
+	for _, tt := range []struct {
+		name string
+		path string
+		cert *x509.Certificate
+		want int
+	}{
+		{name: "public", path: "/", want: StatusSuccess},
+		{name: "no certificate", path: "/private/", want: StatusClientCertificateRequired},
+		{name: "fingerprint", path: "/private/", cert: alice, want: StatusSuccess},
+		{name: "subject", path: "/private/", cert: signedBob, want: StatusSuccess},
+		{name: "unsigned subject", path: "/private/", cert: bob, want: StatusCertificateNotAuthorised},
+		{name: "not authorised", path: "/private/", cert: carol, want: StatusCertificateNotAuthorised},
+		{name: "longest prefix wins", path: "/private/alice/diary.gmi", cert: signedBob, want: StatusCertificateNotAuthorised},
+		{name: "longest prefix allows", path: "/private/alice/diary.gmi", cert: alice, want: StatusSuccess},
+		{name: "dot dot", path: "/foo/../private/hi.gmi", want: StatusClientCertificateRequired},
+		{name: "double slash", path: "//private/hi.gmi", want: StatusClientCertificateRequired},
+		{name: "dot", path: "/./private/hi.gmi", want: StatusClientCertificateRequired},
+		{name: "escaped dot dot", path: "/foo/%2e%2e/private/hi.gmi", want: StatusClientCertificateRequired},
+		{name: "trailing dot", path: "/private/.", want: StatusClientCertificateRequired},
+		{name: "no trailing slash", path: "/private", want: StatusClientCertificateRequired},
+		{name: "dot dot into a longer prefix", path: "/private/x/../alice/diary.gmi", cert: signedBob, want: StatusCertificateNotAuthorised},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse("gemini://localhost" + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rw := new(geminitest.ResponseRecorder)
+			h.HandleGemini(rw, &Request{URL: u, Cert: tt.cert})
+
+			if rw.StatusCode != tt.want {
+				t.Fatalf("wanted status code %d, got: %d", tt.want, rw.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCertAllowlistReplace(t *testing.T) {
+	ca := newTestCA(t)
+	cert := newSignedCert(t, "alice", &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	al := NewCertAllowlist(nil, nil, nil)
+	if al.Authorized(Fingerprint(cert), cert) {
+		t.Fatal("empty allowlist authorized a certificate")
+	}
+
+	al.Replace(nil, []string{"CN=alice"}, nil)
+	if al.Authorized(Fingerprint(cert), cert) {
+		t.Fatal("allowlist without roots matched a subject")
+	}
+
+	al.Replace(nil, []string{"CN=alice"}, roots)
+	if !al.Authorized(Fingerprint(cert), cert) {
+		t.Fatal("allowlist didn't match the distinguished name")
+	}
+}
+
+func newTestCA(t *testing.T) tls.Certificate {
+	return geminitest.NewCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newSignedCert(t *testing.T, cn string, ca *tls.Certificate) *x509.Certificate {
+	return geminitest.NewCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca).Leaf
+}
@@ -0,0 +1,463 @@
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultPort is the TCP port Gemini servers listen on unless told
+// otherwise.
+const DefaultPort = "1965"
+
+// MaxRequestLength is the maximum length of a request URL in bytes, not
+// counting the trailing CRLF.
+const MaxRequestLength = 1024
+
+// DefaultMaxMetaLength is the maximum length of a response meta field in
+// bytes as described in the specification.
+const DefaultMaxMetaLength = 1024
+
+// DefaultMaxRedirects is the number of redirects the default redirect
+// policy follows before giving up.
+const DefaultMaxRedirects = 5
+
+var (
+	// ErrUseLastResponse can be returned by Client.CheckRedirect hooks to
+	// control how redirects are processed. If returned, the next request
+	// is not sent and the most recent response is returned with its body
+	// unclosed.
+	ErrUseLastResponse = errors.New("gemini: use last response")
+
+	// ErrRedirectLoop is returned by the default redirect policy when a
+	// redirect points to a URL that was already visited.
+	ErrRedirectLoop = errors.New("gemini: redirect loop")
+
+	// ErrTooManyRedirects is returned by the default redirect policy when
+	// more than DefaultMaxRedirects redirects were followed.
+	ErrTooManyRedirects = errors.New("gemini: too many redirects")
+
+	// ErrMalformedHeader is returned when a server sends a response
+	// header that doesn't follow the specification.
+	ErrMalformedHeader = errors.New("gemini: malformed response header")
+
+	// ErrBodyTooLarge is returned by reads of a response body that is
+	// larger than the client's MaxBodySize.
+	ErrBodyTooLarge = errors.New("gemini: response body too large")
+)
+
+// Response is a response from a gemini server.
+type Response struct {
+	// Status is the two-digit status code of the response.
+	Status int
+
+	// Meta is the meta field of the response header. For successful
+	// responses this is the MIME type of the body.
+	Meta string
+
+	// Body is the response body. It is empty unless Status is in the 2x
+	// range. The caller must close Body when done with it.
+	Body io.ReadCloser
+
+	// TLS contains information about the TLS connection the response was
+	// received on. It is nil for connections that don't use TLS.
+	TLS *tls.ConnectionState
+
+	// Request is the request that was sent to obtain this response. After
+	// redirects this is the last request sent.
+	Request *Request
+}
+
+// Client is a gemini client in the vein of net/http#Client.
+//
+// The zero value is a usable client that does not verify server
+// certificates. Gemini relies on trust on first use instead of
+// certificate authorities, so callers that care about server identity
+// should set KnownHosts.
+type Client struct {
+	// TLSConfig is the TLS configuration used for gemini connections. If
+	// nil, server certificates are not verified. The ServerName is filled
+	// in from the request URL when empty.
+	TLSConfig *tls.Config
+
+	// KnownHosts optionally verifies server certificates by trust on first
+	// use. When set, certificate authority verification is skipped in
+	// favour of the known hosts store.
+	KnownHosts *KnownHosts
+
+	// Certificate is an optional client certificate presented to servers
+	// that ask for one.
+	Certificate *tls.Certificate
+
+	// DialContext optionally replaces how connections to servers are made.
+	// It receives the host:port of the request URL and must return a
+	// connection ready for the request to be written, doing any TLS
+	// handshake itself. If nil, a TLS connection is made using TLSConfig.
+	DialContext func(ctx context.Context, addr string) (net.Conn, error)
+
+	// CheckRedirect specifies the policy for handling redirects. If
+	// CheckRedirect is not nil, the client calls it before following a
+	// redirect with the upcoming request and the requests made already,
+	// oldest first. If CheckRedirect returns an error, Do returns the
+	// previous Response (with its body closed) and that error, unless the
+	// error is ErrUseLastResponse.
+	//
+	// If CheckRedirect is nil, the client follows at most
+	// DefaultMaxRedirects redirects and refuses redirect loops.
+	CheckRedirect func(req *Request, via []*Request) error
+
+	// MaxMetaLength is the maximum length of the meta field of a response.
+	// If zero, DefaultMaxMetaLength is used.
+	MaxMetaLength int
+
+	// MaxBodySize is the maximum size of a response body in bytes. Reads
+	// past it fail with ErrBodyTooLarge. Zero means no limit.
+	MaxBodySize int64
+
+	// Timeout is the time limit for requests made by this client,
+	// including connecting, following redirects and reading the body. Zero
+	// means no timeout.
+	Timeout time.Duration
+}
+
+// DefaultClient is the default Client and is used by Get.
+var DefaultClient = &Client{}
+
+// NewRequest creates a new request for the given URL.
+func NewRequest(rawURL string) (*Request, error) {
+	return NewRequestWithContext(context.Background(), rawURL)
+}
+
+// NewRequestWithContext creates a new request for the given URL that is
+// cancelled with ctx.
+func NewRequestWithContext(ctx context.Context, rawURL string) (*Request, error) {
+	if ctx == nil {
+		return nil, errors.New("gemini: nil Context")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{URL: u, ctx: ctx}, nil
+}
+
+// Get issues a request to the given URL with DefaultClient.
+func Get(rawURL string) (*Response, error) {
+	return DefaultClient.Get(rawURL)
+}
+
+// Get issues a request to the given URL.
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends a request and returns the response, following redirects as
+// described by CheckRedirect.
+//
+// An error is returned if the server can't be reached or sends a
+// malformed response. Any valid response, including failure statuses, is
+// returned without an error.
+func (c *Client) Do(req *Request) (*Response, error) {
+	ctx := req.Context()
+	var cancel context.CancelFunc = func() {}
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+
+	var via []*Request
+	for {
+		resp, err := c.send(ctx, req)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		if resp.Status/10 != StatusRedirect/10 {
+			if br, ok := resp.Body.(*bodyReader); ok {
+				br.cancel = cancel
+			} else {
+				cancel()
+			}
+			return resp, nil
+		}
+
+		target, err := req.URL.Parse(resp.Meta)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("gemini: bad redirect target %q: %w", resp.Meta, err)
+		}
+		if target.Scheme != "gemini" {
+			// Only gemini redirects are followed, let the caller
+			// decide what to do with anything else.
+			cancel()
+			return resp, nil
+		}
+
+		via = append(via, req)
+		next := req.WithContext(req.Context())
+		next.URL = target
+
+		check := c.CheckRedirect
+		if check == nil {
+			check = defaultCheckRedirect
+		}
+		if err := check(next, via); err != nil {
+			cancel()
+			if errors.Is(err, ErrUseLastResponse) {
+				return resp, nil
+			}
+			return resp, err
+		}
+
+		req = next
+	}
+}
+
+func defaultCheckRedirect(req *Request, via []*Request) error {
+	if len(via) > DefaultMaxRedirects {
+		return ErrTooManyRedirects
+	}
+	for _, prev := range via {
+		if prev.URL.String() == req.URL.String() {
+			return fmt.Errorf("%w: %s", ErrRedirectLoop, req.URL)
+		}
+	}
+	return nil
+}
+
+// send makes a single request. Only successful responses keep the
+// connection open for their body.
+func (c *Client) send(ctx context.Context, req *Request) (*Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("gemini: nil Request.URL")
+	}
+
+	reqLine := req.URL.String()
+	if len(reqLine) > MaxRequestLength {
+		return nil, fmt.Errorf("gemini: request URL is %d bytes, more than the maximum of %d", len(reqLine), MaxRequestLength)
+	}
+
+	conn, err := c.dial(ctx, req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing the connection unblocks any reads or writes when the
+	// context is done.
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	var once sync.Once
+	closeConn := func() error {
+		once.Do(func() { close(stop) })
+		return conn.Close()
+	}
+
+	if _, err := io.WriteString(conn, reqLine+"\r\n"); err != nil {
+		closeConn()
+		return nil, ctxErr(ctx, err)
+	}
+
+	br := bufio.NewReader(conn)
+	status, meta, err := ReadResponseHeader(br, c.maxMetaLength())
+	if err != nil {
+		closeConn()
+		return nil, ctxErr(ctx, err)
+	}
+
+	resp := &Response{
+		Status:  status,
+		Meta:    meta,
+		Request: req,
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		st := tc.ConnectionState()
+		resp.TLS = &st
+	}
+
+	if status/10 != StatusSuccess/10 {
+		closeConn()
+		resp.Body = io.NopCloser(eofReader{})
+		return resp, nil
+	}
+
+	var body io.Reader = br
+	if c.MaxBodySize > 0 {
+		body = &maxBytesReader{r: br, n: c.MaxBodySize}
+	}
+	resp.Body = &bodyReader{r: body, ctx: ctx, close: closeConn}
+	return resp, nil
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+
+	if c.DialContext != nil {
+		return c.DialContext(ctx, addr)
+	}
+
+	if u.Scheme != "gemini" {
+		return nil, fmt.Errorf("gemini: unsupported protocol scheme %q", u.Scheme)
+	}
+
+	var cfg *tls.Config
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+		}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	if c.KnownHosts != nil {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = c.KnownHosts.VerifyPeerCertificate(addr)
+	}
+	if c.Certificate != nil {
+		cfg.Certificates = []tls.Certificate{*c.Certificate}
+	}
+
+	d := tls.Dialer{Config: cfg}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (c *Client) maxMetaLength() int {
+	if c.MaxMetaLength > 0 {
+		return c.MaxMetaLength
+	}
+	return DefaultMaxMetaLength
+}
+
+// ReadResponseHeader reads and validates a response header line of the
+// form "<STATUS><SPACE><META><CR><LF>" from r. The meta field may be at
+// most maxMeta bytes long. Errors caused by invalid headers wrap
+// ErrMalformedHeader.
+func ReadResponseHeader(r *bufio.Reader, maxMeta int) (status int, meta string, err error) {
+	// Two status digits, a space, the meta and CRLF.
+	limit := 2 + 1 + maxMeta + 2
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, "", fmt.Errorf("%w: unexpected EOF", ErrMalformedHeader)
+			}
+			return 0, "", err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= limit {
+			return 0, "", fmt.Errorf("%w: header longer than %d bytes", ErrMalformedHeader, limit)
+		}
+	}
+
+	if len(line) < 4 || line[len(line)-2] != '\r' {
+		return 0, "", fmt.Errorf("%w: header must end with CRLF", ErrMalformedHeader)
+	}
+	line = line[:len(line)-2]
+
+	if line[0] < '1' || line[0] > '6' || line[1] < '0' || line[1] > '9' {
+		return 0, "", fmt.Errorf("%w: invalid status %q", ErrMalformedHeader, line[:2])
+	}
+	status, _ = strconv.Atoi(string(line[:2]))
+
+	switch {
+	case len(line) == 2:
+	case line[2] == ' ':
+		meta = string(line[3:])
+	default:
+		return 0, "", fmt.Errorf("%w: status must be followed by a space", ErrMalformedHeader)
+	}
+
+	if status/10 == StatusSuccess/10 && meta == "" {
+		meta = "text/gemini; charset=utf-8"
+	}
+
+	return status, meta, nil
+}
+
+// ctxErr prefers the context's error over err when the context is done,
+// since closing the connection on cancellation causes confusing network
+// errors.
+func ctxErr(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// bodyReader is the body of a successful response.
+type bodyReader struct {
+	r      io.Reader
+	ctx    context.Context
+	close  func() error
+	cancel context.CancelFunc
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, ErrBodyTooLarge) {
+		err = ctxErr(b.ctx, err)
+	}
+	return n, err
+}
+
+func (b *bodyReader) Close() error {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return b.close()
+}
+
+// maxBytesReader fails reads after n bytes have been read.
+type maxBytesReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.n <= 0 {
+		// Only fail if there actually is more data.
+		var b [1]byte
+		n, err := m.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > m.n {
+		p = p[:m.n]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	return n, err
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
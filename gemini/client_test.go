@@ -0,0 +1,220 @@
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+// newTestCert makes a self-signed certificate for the given common name
+// that is valid between notBefore and notAfter.
+func newTestCert(t *testing.T, cn string, notBefore, notAfter time.Time) tls.Certificate {
+	return geminitest.NewCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    []string{cn},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, nil)
+}
+
+// newTestTLSServer serves h over TLS on a random localhost port and
+// returns the host:port it listens on.
+func newTestTLSServer(t *testing.T, h Handler) (*Server, string) {
+	t.Helper()
+
+	cert := newTestCert(t, "localhost", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(h)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return s, l.Addr().String()
+}
+
+func TestClientGet(t *testing.T) {
+	_, addr := newTestTLSServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Status(StatusSuccess, "text/gemini")
+			fmt.Fprint(w, "# hello")
+		case "/redirect":
+			w.Status(StatusRedirectTemporary, "/")
+		case "/loop":
+			w.Status(StatusRedirectPermanent, "/loop")
+		case "/big":
+			w.Status(StatusSuccess, "text/plain")
+			fmt.Fprint(w, strings.Repeat("a", 100))
+		default:
+			w.Status(StatusNotFound, "not found")
+		}
+	}))
+
+	t.Run("success", func(t *testing.T) {
+		resp, err := Get("gemini://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Status != StatusSuccess || resp.Meta != "text/gemini" {
+			t.Fatalf("wanted 20 text/gemini, got: %d %s", resp.Status, resp.Meta)
+		}
+		if resp.TLS == nil {
+			t.Fatal("wanted TLS connection state")
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "# hello" {
+			t.Fatalf("wanted body %q, got: %q", "# hello", body)
+		}
+	})
+
+	t.Run("failure status", func(t *testing.T) {
+		resp, err := Get("gemini://" + addr + "/nope")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Status != StatusNotFound {
+			t.Fatalf("wanted status code %d, got: %d", StatusNotFound, resp.Status)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		resp, err := Get("gemini://" + addr + "/redirect")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Status != StatusSuccess {
+			t.Fatalf("wanted status code %d, got: %d", StatusSuccess, resp.Status)
+		}
+		if resp.Request.URL.Path != "/" {
+			t.Fatalf("wanted final request for /, got: %s", resp.Request.URL)
+		}
+	})
+
+	t.Run("redirect loop", func(t *testing.T) {
+		_, err := Get("gemini://" + addr + "/loop")
+		if !errors.Is(err, ErrRedirectLoop) {
+			t.Fatalf("wanted ErrRedirectLoop, got: %v", err)
+		}
+	})
+
+	t.Run("use last response", func(t *testing.T) {
+		c := &Client{
+			CheckRedirect: func(*Request, []*Request) error { return ErrUseLastResponse },
+		}
+		resp, err := c.Get("gemini://" + addr + "/redirect")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Status != StatusRedirectTemporary {
+			t.Fatalf("wanted status code %d, got: %d", StatusRedirectTemporary, resp.Status)
+		}
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		c := &Client{MaxBodySize: 10}
+		resp, err := c.Get("gemini://" + addr + "/big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if _, err := io.ReadAll(resp.Body); !errors.Is(err, ErrBodyTooLarge) {
+			t.Fatalf("wanted ErrBodyTooLarge, got: %v", err)
+		}
+	})
+}
+
+func TestClientTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Never answer.
+		io.Copy(io.Discard, conn)
+	}()
+
+	c := &Client{
+		DialContext: func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", l.Addr().String())
+		},
+		Timeout: 50 * time.Millisecond,
+	}
+
+	if _, err := c.Get("gemini://localhost/"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wanted context.DeadlineExceeded, got: %v", err)
+	}
+}
+
+func TestReadResponseHeader(t *testing.T) {
+	for _, tt := range []struct {
+		in     string
+		status int
+		meta   string
+		err    bool
+	}{
+		{in: "20 text/gemini\r\n", status: 20, meta: "text/gemini"},
+		{in: "51 not found\r\n", status: 51, meta: "not found"},
+		{in: "20\r\n", status: 20, meta: "text/gemini; charset=utf-8"},
+		{in: "31 \r\n", status: 31, meta: ""},
+		{in: "20 text/gemini\n", err: true},
+		{in: "2 text/gemini\r\n", err: true},
+		{in: "99 nope\r\n", err: true},
+		{in: "200 text/gemini\r\n", err: true},
+		{in: "20text/gemini\r\n", err: true},
+		{in: "20 text/gemini", err: true},
+		{in: "", err: true},
+		{in: "20 " + strings.Repeat("a", 1025) + "\r\n", err: true},
+	} {
+		t.Run(fmt.Sprintf("%q", tt.in), func(t *testing.T) {
+			status, meta, err := ReadResponseHeader(bufio.NewReader(strings.NewReader(tt.in)), DefaultMaxMetaLength)
+			if tt.err {
+				if !errors.Is(err, ErrMalformedHeader) {
+					t.Fatalf("wanted ErrMalformedHeader, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status || meta != tt.meta {
+				t.Fatalf("wanted %d %q, got: %d %q", tt.status, tt.meta, status, meta)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package gemini
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+)
+
+var (
+	activeConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gemini_active_connections",
+		Help: "The number of gemini connections currently open",
+	})
+
+	connLimitedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gemini_connections_per_ip_limited_total",
+		Help: "The number of gemini connections answered with 44 SLOW DOWN because their client had too many open connections",
+	})
+
+	concurrencyLimitedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gemini_concurrency_limited_total",
+		Help: "The number of gemini requests answered with 41 SERVER UNAVAILABLE because too many requests were being handled",
+	}, []string{"domain"})
+)
+
+// acquireConnSlot waits until fewer than MaxConnections connections are
+// open. It reports false if the server shut down while waiting.
+func (s *Server) acquireConnSlot() bool {
+	if s.MaxConnections <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	if s.connSem == nil {
+		s.connSem = make(chan struct{}, s.MaxConnections)
+	}
+	sem := s.connSem
+	done := s.getDoneChanLocked()
+	s.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// releaseConnSlot gives back a slot taken by acquireConnSlot.
+func (s *Server) releaseConnSlot() {
+	if s.MaxConnections <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	sem := s.connSem
+	s.mu.Unlock()
+
+	<-sem
+}
+
+// acquireIP counts a connection from ip. It reports false if ip already has
+// MaxConnectionsPerIP connections open.
+func (s *Server) acquireIP(ip netaddr.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.perIP == nil {
+		s.perIP = map[netaddr.IP]int{}
+	}
+	if s.perIP[ip] >= s.MaxConnectionsPerIP {
+		return false
+	}
+	s.perIP[ip]++
+	return true
+}
+
+// releaseIP forgets a connection counted by acquireIP.
+func (s *Server) releaseIP(ip netaddr.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.perIP[ip]--
+	if s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+// ConcurrencyLimiter bounds how many requests are handled at once.
+type ConcurrencyLimiter struct {
+	sem chan struct{}
+}
+
+// NewConcurrencyLimiter creates a limiter allowing n requests at once.
+func NewConcurrencyLimiter(n int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{sem: make(chan struct{}, n)}
+}
+
+// LimitConcurrency wraps a handler so that requests arriving while cl is
+// at its limit are answered with StatusUnavailable instead of waiting.
+func LimitConcurrency(h Handler, cl *ConcurrencyLimiter) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		select {
+		case cl.sem <- struct{}{}:
+		default:
+			concurrencyLimitedCount.With(prometheus.Labels{"domain": r.URL.Hostname()}).Inc()
+			w.Status(StatusUnavailable, "too many requests in progress, try again later")
+			return
+		}
+		defer func() { <-cl.sem }()
+
+		h.HandleGemini(w, r)
+	})
+}
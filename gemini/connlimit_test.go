@@ -0,0 +1,119 @@
+package gemini
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+// blockingServer serves a handler that waits for release before answering
+// and signals started for every request.
+func blockingServer(t *testing.T, configure func(*Server)) (addr string, started chan struct{}, release chan struct{}) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started = make(chan struct{}, 10)
+	release = make(chan struct{})
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		started <- struct{}{}
+		<-release
+		w.Status(StatusSuccess, "text/plain")
+	}))
+	configure(s)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return l.Addr().String(), started, release
+}
+
+func dialRequest(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "gemini://localhost/\r\n")
+	return conn
+}
+
+func TestServerMaxConnectionsPerIP(t *testing.T) {
+	addr, started, release := blockingServer(t, func(s *Server) { s.MaxConnectionsPerIP = 1 })
+	defer close(release)
+
+	dialRequest(t, addr)
+	<-started
+
+	second := dialRequest(t, addr)
+	data, err := io.ReadAll(bufio.NewReader(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "44 1\r\n" {
+		t.Fatalf("wanted the second connection to be told to slow down, got: %q", data)
+	}
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	addr, started, release := blockingServer(t, func(s *Server) { s.MaxConnections = 1 })
+
+	first := dialRequest(t, addr)
+	<-started
+
+	dialRequest(t, addr)
+	select {
+	case <-started:
+		t.Fatal("second connection was handled while the first was open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	io.ReadAll(first)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("second connection was not handled after the first closed")
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	cl := NewConcurrencyLimiter(1)
+	u, _ := url.Parse("gemini://localhost/")
+
+	inner := make(chan int, 1)
+	h := LimitConcurrency(HandlerFunc(func(w ResponseWriter, r *Request) {
+		rw := new(geminitest.ResponseRecorder)
+		LimitConcurrency(NotFound(), cl).HandleGemini(rw, r)
+		inner <- rw.StatusCode
+		w.Status(StatusSuccess, "text/plain")
+	}), cl)
+
+	rw := new(geminitest.ResponseRecorder)
+	h.HandleGemini(rw, &Request{URL: u})
+
+	if status := <-inner; status != StatusUnavailable {
+		t.Fatalf("wanted nested request over the limit to get %d, got: %d", StatusUnavailable, status)
+	}
+	if rw.StatusCode != StatusSuccess {
+		t.Fatalf("wanted status code %d, got: %d", StatusSuccess, rw.StatusCode)
+	}
+
+	rw = new(geminitest.ResponseRecorder)
+	LimitConcurrency(NotFound(), cl).HandleGemini(rw, &Request{URL: u})
+	if rw.StatusCode != StatusNotFound {
+		t.Fatalf("wanted the limiter to be released, got: %d", rw.StatusCode)
+	}
+}
@@ -0,0 +1,127 @@
+// Package gemtext reads and writes text/gemini documents, the native
+// hypertext format of gemini, as described here:
+// gemini://gemini.circumlunar.space/docs/specification.gmi
+//
+// A document is a sequence of lines, each of one of the types in this
+// package. Parser turns a document into lines as it is read and Writer
+// turns lines back into a document.
+package gemtext
+
+import "strings"
+
+// Line is a line of a gemtext document.
+type Line interface {
+	// String returns the line as gemtext, without a line ending. Lines
+	// that would be read back as another type of line are escaped.
+	String() string
+}
+
+// Text is a line of text.
+type Text string
+
+// Link is a link line. URL may be relative to the URL of the document.
+type Link struct {
+	URL   string
+	Label string
+}
+
+// Heading is a heading line. Level is 1, 2 or 3.
+type Heading struct {
+	Level int
+	Text  string
+}
+
+// ListItem is an unordered list item.
+type ListItem string
+
+// Quote is a quote line.
+type Quote string
+
+// PreformatToggle starts or ends a preformatted block. Alt is the alt text
+// of the block, which only a starting toggle has.
+type PreformatToggle struct {
+	Alt string
+}
+
+// Preformatted is a line inside a preformatted block, to be shown as it
+// is.
+type Preformatted string
+
+// oneLine keeps s on one line.
+func oneLine(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+// hasMarkup reports whether a text line starting with s would be read as
+// another type of line.
+func hasMarkup(s string) bool {
+	for _, prefix := range []string{"=>", "#", "* ", ">", "```"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// String escapes text that starts like another type of line with a space,
+// since gemtext has no other way to do it.
+func (t Text) String() string {
+	s := oneLine(string(t))
+	if hasMarkup(s) {
+		return " " + s
+	}
+	return s
+}
+
+// String percent-encodes any whitespace in the URL, which would otherwise
+// end it early. A link without a URL can only be written as text.
+func (l Link) String() string {
+	u := l.URL
+	if strings.ContainsAny(u, " \t\r\n") {
+		u = strings.NewReplacer(" ", "%20", "\t", "%09", "\r", "%0D", "\n", "%0A").Replace(u)
+	}
+
+	label := strings.TrimSpace(oneLine(l.Label))
+	if u == "" {
+		// A link needs a URL, so all that can be kept is the label.
+		return Text(label).String()
+	}
+	if label == "" {
+		return "=> " + u
+	}
+	return "=> " + u + " " + label
+}
+
+func (h Heading) String() string {
+	level := h.Level
+	if level < 1 {
+		level = 1
+	} else if level > 3 {
+		level = 3
+	}
+	return strings.Repeat("#", level) + " " + strings.TrimSpace(oneLine(h.Text))
+}
+
+func (li ListItem) String() string {
+	return "* " + oneLine(string(li))
+}
+
+func (q Quote) String() string {
+	return "> " + oneLine(string(q))
+}
+
+func (pt PreformatToggle) String() string {
+	return "```" + oneLine(pt.Alt)
+}
+
+// String escapes a line that would end the block with a space.
+func (p Preformatted) String() string {
+	s := oneLine(string(p))
+	if strings.HasPrefix(s, "```") {
+		return " " + s
+	}
+	return s
+}
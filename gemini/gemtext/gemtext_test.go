@@ -0,0 +1,176 @@
+package gemtext
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const document = "# Title\n" +
+	"## Section\n" +
+	"### Subsection\n" +
+	"Some text.\n" +
+	"\n" +
+	"=> gemini://example.com/ Example\n" +
+	"=> /relative\n" +
+	"* item\n" +
+	"> quoted\n" +
+	"```alt text\n" +
+	"=> not a link\n" +
+	"# not a heading\n" +
+	"```\n" +
+	"last\n"
+
+var documentLines = []Line{
+	Heading{Level: 1, Text: "Title"},
+	Heading{Level: 2, Text: "Section"},
+	Heading{Level: 3, Text: "Subsection"},
+	Text("Some text."),
+	Text(""),
+	Link{URL: "gemini://example.com/", Label: "Example"},
+	Link{URL: "/relative"},
+	ListItem("item"),
+	Quote("quoted"),
+	PreformatToggle{Alt: "alt text"},
+	Preformatted("=> not a link"),
+	Preformatted("# not a heading"),
+	PreformatToggle{},
+	Text("last"),
+}
+
+func TestParse(t *testing.T) {
+	lines, err := Parse(strings.NewReader(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, documentLines) {
+		t.Fatalf("wanted %#v, got: %#v", documentLines, lines)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	for line, want := range map[string]Line{
+		"=>\tgemini://example.com/   spaced  label ": Link{URL: "gemini://example.com/", Label: "spaced  label"},
+		"=>":             Text("=>"),
+		"=>   ":          Text("=>   "),
+		"#no space":      Heading{Level: 1, Text: "no space"},
+		"#### four":      Heading{Level: 3, Text: "# four"},
+		"*not an item":   Text("*not an item"),
+		">no space":      Quote("no space"),
+		" # indented":    Text(" # indented"),
+		"```  padded  ":  PreformatToggle{Alt: "padded"},
+		"plain text ok.": Text("plain text ok."),
+	} {
+		var p Parser
+		if got := p.ParseLine(line); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%q: wanted %#v, got: %#v", line, want, got)
+		}
+	}
+}
+
+func TestParserLineEndings(t *testing.T) {
+	lines, err := Parse(strings.NewReader("one\r\n=> two\r\nthree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Line{Text("one"), Link{URL: "two"}, Text("three")}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("wanted %#v, got: %#v", want, lines)
+	}
+
+	p := NewParser(strings.NewReader("```\nunterminated"))
+	for {
+		if _, err := p.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !p.Preformatted() {
+		t.Fatal("wanted the parser to report the open preformatted block")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, line := range documentLines {
+		if err := w.WriteLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if buf.String() != document {
+		t.Fatalf("wanted %q, got: %q", document, buf.String())
+	}
+}
+
+func TestWriterEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Text("# not a heading\n=> not a link")
+	w.Link("/with space", "label\nacross lines")
+	w.Link("/no-label", "  ")
+	w.Heading(2, "  heading\n")
+	w.ListItem("* nested?")
+	w.Quote("first\nsecond")
+	w.Preformatted("alt\ntext", "```\ncode")
+	if err := w.Text(">last"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Line{
+		Text(" # not a heading"),
+		Text(" => not a link"),
+		Link{URL: "/with%20space", Label: "label across lines"},
+		Link{URL: "/no-label"},
+		Heading{Level: 2, Text: "heading"},
+		ListItem("* nested?"),
+		Quote("first"),
+		Quote("second"),
+		PreformatToggle{Alt: "alt text"},
+		Preformatted(" ```"),
+		Preformatted("code"),
+		PreformatToggle{},
+		Text(" >last"),
+	}
+
+	lines, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("wanted %#v, got: %#v", want, lines)
+	}
+}
+
+func TestWriterInvalidLines(t *testing.T) {
+	w := NewWriter(io.Discard)
+	if err := w.Link("", "label"); !errors.Is(err, ErrInvalidLine) {
+		t.Fatalf("wanted ErrInvalidLine for an empty link, got: %v", err)
+	}
+	if err := w.Heading(4, "too deep"); !errors.Is(err, ErrInvalidLine) {
+		t.Fatalf("wanted ErrInvalidLine for a level 4 heading, got: %v", err)
+	}
+
+	w.WriteLine(PreformatToggle{})
+	if err := w.Preformatted("", "nested"); !errors.Is(err, ErrInvalidLine) {
+		t.Fatalf("wanted ErrInvalidLine for a nested preformatted block, got: %v", err)
+	}
+}
+
+func TestWriterInsidePreformattedBlock(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteLine(PreformatToggle{Alt: "open"})
+	w.WriteLine(Link{URL: "/x", Label: "shown as is"})
+	w.WriteLine(Text("```"))
+	w.WriteLine(PreformatToggle{Alt: "ignored"})
+
+	if want := "```open\n=> /x shown as is\n ```\n```\n"; buf.String() != want {
+		t.Fatalf("wanted %q, got: %q", want, buf.String())
+	}
+}
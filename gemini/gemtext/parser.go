@@ -0,0 +1,99 @@
+package gemtext
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Parser reads the lines of a gemtext document one at a time, so that
+// documents can be handled as they stream in. Lines can come from an
+// io.Reader with Next or be fed in with ParseLine.
+//
+// The zero value is a Parser for lines fed in with ParseLine.
+type Parser struct {
+	r   *bufio.Reader
+	pre bool
+}
+
+// NewParser creates a Parser reading a document from r.
+func NewParser(r io.Reader) *Parser {
+	return &Parser{r: bufio.NewReader(r)}
+}
+
+// Next reads the next line of the document. It returns io.EOF once there
+// are no more lines.
+func (p *Parser) Next() (Line, error) {
+	line, err := p.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return p.ParseLine(line), nil
+}
+
+// ParseLine parses a line, without its line ending, that comes after the
+// lines parsed so far.
+func (p *Parser) ParseLine(line string) Line {
+	if strings.HasPrefix(line, "```") {
+		p.pre = !p.pre
+		if !p.pre {
+			return PreformatToggle{}
+		}
+		return PreformatToggle{Alt: strings.TrimSpace(line[3:])}
+	}
+	if p.pre {
+		return Preformatted(line)
+	}
+
+	switch {
+	case strings.HasPrefix(line, "=>"):
+		rest := strings.TrimLeft(line[2:], " \t")
+		if rest == "" {
+			return Text(line)
+		}
+		link := Link{URL: rest}
+		if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			link.URL, link.Label = rest[:i], strings.TrimSpace(rest[i:])
+		}
+		return link
+
+	case strings.HasPrefix(line, "###"):
+		return Heading{Level: 3, Text: strings.TrimSpace(line[3:])}
+	case strings.HasPrefix(line, "##"):
+		return Heading{Level: 2, Text: strings.TrimSpace(line[2:])}
+	case strings.HasPrefix(line, "#"):
+		return Heading{Level: 1, Text: strings.TrimSpace(line[1:])}
+
+	case strings.HasPrefix(line, "* "):
+		return ListItem(line[2:])
+
+	case strings.HasPrefix(line, ">"):
+		return Quote(strings.TrimLeft(line[1:], " \t"))
+	}
+
+	return Text(line)
+}
+
+// Preformatted reports whether the lines parsed so far left a preformatted
+// block open.
+func (p *Parser) Preformatted() bool {
+	return p.pre
+}
+
+// Parse reads a whole document.
+func Parse(r io.Reader) ([]Line, error) {
+	p := NewParser(r)
+	var result []Line
+	for {
+		line, err := p.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		result = append(result, line)
+	}
+}
@@ -0,0 +1,118 @@
+package gemtext
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrInvalidLine is returned by Writer methods given something that can't
+// be written as the line asked for.
+var ErrInvalidLine = errors.New("gemtext: invalid line")
+
+// Writer writes a gemtext document. Every line is escaped as needed so
+// that it is read back as the type of line it was written as.
+//
+// After a write fails, all further writes return the same error.
+type Writer struct {
+	w   io.Writer
+	pre bool
+	err error
+}
+
+// NewWriter creates a Writer writing a document to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteLine writes a line. Preformatted lines are only read back as such
+// inside a preformatted block, which is opened and closed by writing
+// PreformatToggle lines; Preformatted takes care of that.
+func (w *Writer) WriteLine(l Line) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	s := l.String()
+	if _, ok := l.(PreformatToggle); ok {
+		if w.pre {
+			// Closing toggles have no alt text.
+			s = "```"
+		}
+		w.pre = !w.pre
+	} else if w.pre {
+		// Inside a block every line is preformatted, whatever it was meant
+		// to be.
+		s = Preformatted(s).String()
+	}
+
+	_, w.err = io.WriteString(w.w, s+"\n")
+	return w.err
+}
+
+// Text writes text. Each line of text becomes a text line of its own.
+func (w *Writer) Text(text string) error {
+	for _, line := range splitLines(text) {
+		if err := w.WriteLine(Text(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Link writes a link to rawURL with an optional label.
+func (w *Writer) Link(rawURL, label string) error {
+	if rawURL == "" {
+		return fmt.Errorf("%w: link without a URL", ErrInvalidLine)
+	}
+	return w.WriteLine(Link{URL: rawURL, Label: label})
+}
+
+// Heading writes a heading of the given level, from 1 to 3.
+func (w *Writer) Heading(level int, text string) error {
+	if level < 1 || level > 3 {
+		return fmt.Errorf("%w: heading level %d", ErrInvalidLine, level)
+	}
+	return w.WriteLine(Heading{Level: level, Text: text})
+}
+
+// ListItem writes an unordered list item.
+func (w *Writer) ListItem(text string) error {
+	return w.WriteLine(ListItem(text))
+}
+
+// Quote writes a quote. Each line of the quote becomes a quote line of its
+// own.
+func (w *Writer) Quote(text string) error {
+	for _, line := range splitLines(text) {
+		if err := w.WriteLine(Quote(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Preformatted writes text as a preformatted block with the given alt
+// text.
+func (w *Writer) Preformatted(alt, text string) error {
+	if w.pre {
+		return fmt.Errorf("%w: preformatted block inside another", ErrInvalidLine)
+	}
+
+	if err := w.WriteLine(PreformatToggle{Alt: alt}); err != nil {
+		return err
+	}
+	for _, line := range splitLines(text) {
+		if err := w.WriteLine(Preformatted(line)); err != nil {
+			return err
+		}
+	}
+	return w.WriteLine(PreformatToggle{})
+}
+
+// splitLines splits text into lines, ignoring a final line ending.
+func splitLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
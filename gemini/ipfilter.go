@@ -0,0 +1,90 @@
+package gemini
+
+import (
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+)
+
+var ipRejectCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gemini_ip_rejections_total",
+	Help: "The number of connections or requests rejected because of the client IP address",
+}, []string{"domain"})
+
+// IPFilter decides which client addresses may connect based on allow and
+// deny lists. Addresses in Deny are always rejected. If Allow is set, only
+// addresses in it are accepted.
+type IPFilter struct {
+	Allow *netaddr.IPSet
+	Deny  *netaddr.IPSet
+}
+
+// Allowed reports whether ip passes the filter. IPv4-mapped IPv6 addresses
+// are treated as the IPv4 addresses they map.
+func (f *IPFilter) Allowed(ip netaddr.IP) bool {
+	ip = ip.Unmap()
+	if f.Deny != nil && f.Deny.Contains(ip) {
+		return false
+	}
+	if f.Allow != nil && !f.Allow.Contains(ip) {
+		return false
+	}
+	return true
+}
+
+// RestrictIPs wraps a handler so that requests from addresses that don't
+// pass the filter are answered with StatusProxyRequestRefused. Requests
+// without a remote address, such as those served over unix sockets, are
+// passed through.
+func RestrictIPs(h Handler, f *IPFilter) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if ip := r.RemoteAddr.IP(); !ip.IsZero() && !f.Allowed(ip) {
+			ipRejectCount.With(prometheus.Labels{"domain": r.URL.Hostname()}).Inc()
+			w.Status(StatusProxyRequestRefused, "access denied")
+			return
+		}
+		h.HandleGemini(w, r)
+	})
+}
+
+// FilterListener wraps a listener so that connections from addresses for
+// which allowed returns false are closed as soon as they are accepted,
+// before any TLS handshake. Connections that don't come from an IP
+// address, such as unix socket connections, are always accepted.
+func FilterListener(l net.Listener, allowed func(netaddr.IP) bool) net.Listener {
+	return &filterListener{Listener: l, allowed: allowed}
+}
+
+type filterListener struct {
+	net.Listener
+	allowed func(netaddr.IP) bool
+}
+
+func (fl *filterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := fl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if ip, ok := connIP(conn); ok && !fl.allowed(ip) {
+			ipRejectCount.With(prometheus.Labels{"domain": ""}).Inc()
+			conn.Close()
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+// connIP returns the IP address of the remote end of conn, if it has one.
+func connIP(conn net.Conn) (netaddr.IP, bool) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return netaddr.IP{}, false
+	}
+	ip, ok := netaddr.FromStdIP(addr.IP)
+	return ip, ok
+}
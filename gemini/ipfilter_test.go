@@ -0,0 +1,93 @@
+package gemini
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini/geminitest"
+	"inet.af/netaddr"
+)
+
+func mustIPSet(t *testing.T, prefixes ...string) *netaddr.IPSet {
+	t.Helper()
+
+	var b netaddr.IPSetBuilder
+	for _, p := range prefixes {
+		b.AddPrefix(netaddr.MustParseIPPrefix(p))
+	}
+	set, err := b.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestIPFilter(t *testing.T) {
+	f := &IPFilter{
+		Allow: mustIPSet(t, "192.0.2.0/24", "2001:db8::/32"),
+		Deny:  mustIPSet(t, "192.0.2.66/32"),
+	}
+
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.66", false},
+		{"::ffff:192.0.2.66", false},
+		{"198.51.100.1", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	} {
+		if got := f.Allowed(netaddr.MustParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Allowed(%s) = %v, wanted %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestRestrictIPs(t *testing.T) {
+	h := RestrictIPs(NotFound(), &IPFilter{Deny: mustIPSet(t, "192.0.2.0/24")})
+	u, _ := url.Parse("gemini://localhost/")
+
+	rw := new(geminitest.ResponseRecorder)
+	h.HandleGemini(rw, &Request{URL: u, RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:4000")})
+	if rw.StatusCode != StatusProxyRequestRefused {
+		t.Fatalf("wanted status code %d, got: %d", StatusProxyRequestRefused, rw.StatusCode)
+	}
+
+	rw = new(geminitest.ResponseRecorder)
+	h.HandleGemini(rw, &Request{URL: u})
+	if rw.StatusCode != StatusNotFound {
+		t.Fatalf("wanted request without an address to pass, got: %d", rw.StatusCode)
+	}
+}
+
+func TestFilterListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &IPFilter{Deny: mustIPSet(t, "127.0.0.0/8")}
+	s := NewServer(NotFound())
+	go s.Serve(FilterListener(l, f.Allowed))
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("wanted the connection to be dropped, got: %q", data)
+	}
+}
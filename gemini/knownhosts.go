@@ -0,0 +1,298 @@
+package gemini
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate as a lower
+// case hex string.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// KnownHost is a certificate fingerprint that a client trusts for a host.
+type KnownHost struct {
+	// Addr is the host:port the fingerprint applies to.
+	Addr string
+
+	// Fingerprint is the SHA-256 fingerprint of the host's certificate as
+	// returned by Fingerprint.
+	Fingerprint string
+
+	// Expires is when the certificate stops being valid. Once it has
+	// passed, a new certificate for the host is trusted on first use
+	// again. The zero value means the entry never expires.
+	Expires time.Time
+
+	// Pinned entries never rotate, even after they expire.
+	Pinned bool
+}
+
+func (kh KnownHost) expired(now time.Time) bool {
+	return !kh.Expires.IsZero() && now.After(kh.Expires)
+}
+
+// CertificateMismatchError is returned when a host presents a certificate
+// different from the one it is known by.
+type CertificateMismatchError struct {
+	// Known is the trusted entry for the host.
+	Known KnownHost
+
+	// Fingerprint is the fingerprint of the certificate the host presented.
+	Fingerprint string
+}
+
+func (e *CertificateMismatchError) Error() string {
+	return fmt.Sprintf("gemini: certificate for %s has fingerprint %s, but it is known by %s", e.Known.Addr, e.Fingerprint, e.Known.Fingerprint)
+}
+
+// KnownHosts is a trust on first use certificate store for gemini clients.
+// The first certificate seen for a host is recorded and later connections
+// must present the same one until it expires.
+//
+// The store is safe for concurrent use. When it is backed by a file, every
+// change is written back to that file.
+//
+// The file format has one host per line:
+//
+//	<host:port> <sha256 fingerprint> <expiry as RFC 3339 or "-"> [pinned]
+//
+// Blank lines and lines starting with # are ignored.
+type KnownHosts struct {
+	path string
+
+	mu    sync.RWMutex
+	hosts map[string]KnownHost
+}
+
+// NewKnownHosts creates an empty in-memory known hosts store.
+func NewKnownHosts() *KnownHosts {
+	return &KnownHosts{hosts: map[string]KnownHost{}}
+}
+
+// LoadKnownHosts loads a known hosts store from the file at path. The file
+// is created the first time a host is recorded if it doesn't exist yet.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	kh := NewKnownHosts()
+	kh.path = path
+
+	fin, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return kh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	sc := bufio.NewScanner(fin)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		host, err := parseKnownHost(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		kh.hosts[host.Addr] = host
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return kh, nil
+}
+
+func parseKnownHost(line string) (KnownHost, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 && len(fields) != 4 {
+		return KnownHost{}, fmt.Errorf("wanted 3 or 4 fields, got %d", len(fields))
+	}
+
+	host := KnownHost{
+		Addr:        fields[0],
+		Fingerprint: strings.ToLower(fields[1]),
+	}
+
+	if fields[2] != "-" {
+		t, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			return KnownHost{}, fmt.Errorf("invalid expiry: %v", err)
+		}
+		host.Expires = t
+	}
+
+	if len(fields) == 4 {
+		if fields[3] != "pinned" {
+			return KnownHost{}, fmt.Errorf("unknown flag %q", fields[3])
+		}
+		host.Pinned = true
+	}
+
+	return host, nil
+}
+
+func (kh KnownHost) String() string {
+	expires := "-"
+	if !kh.Expires.IsZero() {
+		expires = kh.Expires.UTC().Format(time.RFC3339)
+	}
+
+	result := fmt.Sprintf("%s %s %s", kh.Addr, kh.Fingerprint, expires)
+	if kh.Pinned {
+		result += " pinned"
+	}
+	return result
+}
+
+// Lookup returns the known entry for a host:port.
+func (k *KnownHosts) Lookup(addr string) (KnownHost, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	host, ok := k.hosts[addr]
+	return host, ok
+}
+
+// Hosts returns all known entries sorted by address.
+func (k *KnownHosts) Hosts() []KnownHost {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	result := make([]KnownHost, 0, len(k.hosts))
+	for _, host := range k.hosts {
+		result = append(result, host)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Addr < result[j].Addr })
+	return result
+}
+
+// Add records an entry, replacing any existing entry for the same host.
+func (k *KnownHosts) Add(host KnownHost) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	host.Fingerprint = strings.ToLower(host.Fingerprint)
+	k.hosts[host.Addr] = host
+	return k.saveLocked()
+}
+
+// Pin trusts only the certificate with the given fingerprint for a host,
+// regardless of its expiry.
+func (k *KnownHosts) Pin(addr, fingerprint string) error {
+	return k.Add(KnownHost{Addr: addr, Fingerprint: fingerprint, Pinned: true})
+}
+
+// Forget removes the entry for a host so that its next certificate is
+// trusted on first use.
+func (k *KnownHosts) Forget(addr string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.hosts, addr)
+	return k.saveLocked()
+}
+
+// Check verifies that cert is the certificate host:port is known by.
+//
+// Unknown hosts are trusted and recorded. If the host is known by another
+// certificate that has expired and isn't pinned, the new certificate
+// replaces it. Otherwise a *CertificateMismatchError is returned.
+func (k *KnownHosts) Check(addr string, cert *x509.Certificate) error {
+	fp := Fingerprint(cert)
+	now := time.Now()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, ok := k.hosts[addr]
+	switch {
+	case ok && known.Fingerprint == fp:
+		return nil
+	case ok && (known.Pinned || !known.expired(now)):
+		return &CertificateMismatchError{Known: known, Fingerprint: fp}
+	}
+
+	k.hosts[addr] = KnownHost{
+		Addr:        addr,
+		Fingerprint: fp,
+		Expires:     cert.NotAfter,
+	}
+	return k.saveLocked()
+}
+
+// VerifyPeerCertificate returns a function suitable for
+// tls.Config.VerifyPeerCertificate that checks the leaf certificate of a
+// connection to addr against the store. addr is normalized to include the
+// default gemini port if it has none.
+//
+// The tls.Config must also set InsecureSkipVerify so that the usual
+// certificate authority checks are skipped.
+func (k *KnownHosts) VerifyPeerCertificate(addr string) func([][]byte, [][]*x509.Certificate) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, DefaultPort)
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("gemini: server presented no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("gemini: can't parse server certificate: %w", err)
+		}
+		return k.Check(addr, cert)
+	}
+}
+
+// saveLocked writes the store back to its file, if it has one. k.mu must
+// be held.
+func (k *KnownHosts) saveLocked() error {
+	if k.path == "" {
+		return nil
+	}
+
+	addrs := make([]string, 0, len(k.hosts))
+	for addr := range k.hosts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var sb strings.Builder
+	for _, addr := range addrs {
+		fmt.Fprintln(&sb, k.hosts[addr])
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), filepath.Base(k.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), k.path)
+}
@@ -0,0 +1,132 @@
+package gemini
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKnownHostsCheck(t *testing.T) {
+	now := time.Now()
+	first := newTestCert(t, "localhost", now.Add(-time.Hour), now.Add(time.Hour)).Leaf
+	second := newTestCert(t, "localhost", now.Add(-time.Hour), now.Add(time.Hour)).Leaf
+	expired := newTestCert(t, "localhost", now.Add(-2*time.Hour), now.Add(-time.Hour)).Leaf
+
+	t.Run("trust on first use", func(t *testing.T) {
+		kh := NewKnownHosts()
+		if err := kh.Check("localhost:1965", first); err != nil {
+			t.Fatal(err)
+		}
+		if err := kh.Check("localhost:1965", first); err != nil {
+			t.Fatal(err)
+		}
+
+		host, ok := kh.Lookup("localhost:1965")
+		if !ok {
+			t.Fatal("host was not recorded")
+		}
+		if host.Fingerprint != Fingerprint(first) {
+			t.Fatalf("wanted fingerprint %s, got: %s", Fingerprint(first), host.Fingerprint)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		kh := NewKnownHosts()
+		if err := kh.Check("localhost:1965", first); err != nil {
+			t.Fatal(err)
+		}
+
+		var merr *CertificateMismatchError
+		if err := kh.Check("localhost:1965", second); !errors.As(err, &merr) {
+			t.Fatalf("wanted *CertificateMismatchError, got: %v", err)
+		}
+		if merr.Fingerprint != Fingerprint(second) {
+			t.Fatalf("wanted fingerprint %s in error, got: %s", Fingerprint(second), merr.Fingerprint)
+		}
+	})
+
+	t.Run("rotation after expiry", func(t *testing.T) {
+		kh := NewKnownHosts()
+		if err := kh.Check("localhost:1965", expired); err != nil {
+			t.Fatal(err)
+		}
+		if err := kh.Check("localhost:1965", first); err != nil {
+			t.Fatalf("wanted expired certificate to be replaced, got: %v", err)
+		}
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		kh := NewKnownHosts()
+		if err := kh.Add(KnownHost{Addr: "localhost:1965", Fingerprint: Fingerprint(expired), Expires: expired.NotAfter, Pinned: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		var merr *CertificateMismatchError
+		if err := kh.Check("localhost:1965", first); !errors.As(err, &merr) {
+			t.Fatalf("wanted *CertificateMismatchError for pinned host, got: %v", err)
+		}
+	})
+}
+
+func TestKnownHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	cert := newTestCert(t, "localhost", time.Now().Add(-time.Hour), time.Now().Add(time.Hour)).Leaf
+
+	kh, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kh.Check("localhost:1965", cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := kh.Pin("example.com:1965", "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+
+	kh2, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := kh2.Hosts()
+	if len(hosts) != 2 {
+		t.Fatalf("wanted 2 hosts, got: %v", hosts)
+	}
+	if hosts[0].Addr != "example.com:1965" || hosts[0].Fingerprint != "abcdef" || !hosts[0].Pinned || !hosts[0].Expires.IsZero() {
+		t.Fatalf("pinned host did not round trip: %+v", hosts[0])
+	}
+	if hosts[1].Fingerprint != Fingerprint(cert) || !hosts[1].Expires.Equal(cert.NotAfter.Truncate(time.Second)) {
+		t.Fatalf("host did not round trip: %+v", hosts[1])
+	}
+}
+
+func TestClientKnownHosts(t *testing.T) {
+	_, addr := newTestTLSServer(t, NotFound())
+	_, other := newTestTLSServer(t, NotFound())
+
+	kh := NewKnownHosts()
+	c := &Client{KnownHosts: kh}
+
+	resp, err := c.Get("gemini://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if _, ok := kh.Lookup(addr); !ok {
+		t.Fatal("server certificate was not recorded")
+	}
+
+	// Pretend the other server is the first one by pinning the first
+	// server's fingerprint for it.
+	known, _ := kh.Lookup(addr)
+	if err := kh.Pin(other, known.Fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	var merr *CertificateMismatchError
+	if _, err := c.Get("gemini://" + other + "/"); !errors.As(err, &merr) {
+		t.Fatalf("wanted *CertificateMismatchError, got: %v", err)
+	}
+}
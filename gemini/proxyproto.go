@@ -0,0 +1,527 @@
+package gemini
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// DefaultProxyHeaderTimeout is how long a trusted source has to send its
+// PROXY protocol header when HeaderTimeout is not set.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// DefaultMaxPendingProxyHeaders is how many connections may wait for
+// their PROXY protocol header to be read or to be accepted when
+// MaxPendingHeaders is not set.
+const DefaultMaxPendingProxyHeaders = 128
+
+// ErrInvalidProxyHeader is returned when a trusted source sends a
+// connection that doesn't start with a valid PROXY protocol header.
+var ErrInvalidProxyHeader = errors.New("gemini: invalid PROXY protocol header")
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Types of the PROXY protocol version 2 TLVs a ProxyHeader is made of.
+// ProxyTLVAuthority is defined by the specification, the others are in
+// the range it reserves for custom use.
+const (
+	// ProxyTLVAuthority holds the server name the client asked for with
+	// SNI.
+	ProxyTLVAuthority = 0x02
+
+	// ProxyTLVClientCert holds the DER encoded client certificate.
+	ProxyTLVClientCert = 0xE0
+
+	// ProxyTLVClientCertFingerprint holds the SHA-256 fingerprint of the
+	// client certificate as returned by Fingerprint.
+	ProxyTLVClientCertFingerprint = 0xE1
+)
+
+// ProxyHeader is what a PROXY protocol header says about the connection
+// it was sent on.
+type ProxyHeader struct {
+	// Source is the address of the client. If it is zero, the connection
+	// was not proxied for anyone, such as for a health check.
+	Source netaddr.IPPort
+
+	// Destination is the address the client connected to.
+	Destination netaddr.IPPort
+
+	// ServerName is the server name the client asked for with SNI.
+	ServerName string
+
+	// Cert is the certificate the client presented.
+	Cert *x509.Certificate
+
+	// CertFingerprint is the fingerprint of the certificate the client
+	// presented. When sending a header, it is only used if Cert is nil.
+	CertFingerprint string
+}
+
+// WriteTo writes h as a PROXY protocol version 2 header. If Destination
+// is zero, the unspecified address of the same family as Source is sent
+// instead.
+func (h *ProxyHeader) WriteTo(w io.Writer) (int64, error) {
+	buf := append([]byte(nil), proxyV2Signature...)
+
+	if h.Source.IsZero() {
+		// LOCAL command, no addresses.
+		buf = append(buf, 0x20, 0x00, 0, 0)
+		n, err := w.Write(buf)
+		return int64(n), err
+	}
+
+	src := h.Source.IP().Unmap()
+	dst := h.Destination.IP().Unmap()
+	var family byte
+	switch {
+	case src.Is4():
+		family = 0x11
+		if !dst.Is4() {
+			dst = netaddr.IPv4(0, 0, 0, 0)
+		}
+	default:
+		family = 0x21
+		if !dst.Is6() {
+			dst = netaddr.IPv6Unspecified()
+		}
+	}
+	buf = append(buf, 0x21, family, 0, 0)
+
+	srcBytes, dstBytes := src.As16(), dst.As16()
+	if src.Is4() {
+		buf = append(buf, srcBytes[12:]...)
+		buf = append(buf, dstBytes[12:]...)
+	} else {
+		buf = append(buf, srcBytes[:]...)
+		buf = append(buf, dstBytes[:]...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, h.Source.Port())
+	buf = binary.BigEndian.AppendUint16(buf, h.Destination.Port())
+
+	if h.ServerName != "" {
+		buf = appendProxyTLV(buf, ProxyTLVAuthority, []byte(h.ServerName))
+	}
+	switch {
+	case h.Cert != nil:
+		buf = appendProxyTLV(buf, ProxyTLVClientCert, h.Cert.Raw)
+	case h.CertFingerprint != "":
+		buf = appendProxyTLV(buf, ProxyTLVClientCertFingerprint, []byte(h.CertFingerprint))
+	}
+
+	length := len(buf) - 16
+	if length > 0xffff {
+		return 0, fmt.Errorf("gemini: PROXY protocol header too long (%d bytes)", length)
+	}
+	binary.BigEndian.PutUint16(buf[14:16], uint16(length))
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func appendProxyTLV(buf []byte, typ byte, value []byte) []byte {
+	buf = append(buf, typ)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// ProxyProtocol configures how PROXY protocol headers are read. The PROXY
+// protocol is how load balancers such as HAProxy tell the server the
+// address of the client they are forwarding a connection for.
+type ProxyProtocol struct {
+	// Trusted is the set of addresses that are allowed to send PROXY
+	// protocol headers, usually the load balancers in front of the server.
+	// Connections from trusted addresses must start with a header and
+	// connections from other addresses are taken as they are. Unix socket
+	// connections are always trusted. If Trusted is nil, no address is
+	// trusted unless TrustAll is set.
+	Trusted *netaddr.IPSet
+
+	// TrustAll trusts every address, no matter what is in Trusted. Anyone
+	// who can connect then gets to pick the address and client certificate
+	// they are seen with, so this is only safe when the server can't be
+	// reached without going through the load balancer.
+	TrustAll bool
+
+	// HeaderTimeout is how long a trusted source has to send the header.
+	// Zero means DefaultProxyHeaderTimeout.
+	HeaderTimeout time.Duration
+
+	// MaxPendingHeaders is the maximum number of connections whose headers
+	// are being read or that are waiting to be accepted. When it is
+	// reached, no more connections are accepted from the underlying
+	// listener until one of them is. Zero means
+	// DefaultMaxPendingProxyHeaders.
+	MaxPendingHeaders int
+}
+
+// trusted reports whether conn is allowed to send a PROXY protocol header.
+func (pp *ProxyProtocol) trusted(conn net.Conn) bool {
+	ip, ok := connIP(conn)
+	if !ok || pp.TrustAll {
+		return true
+	}
+	return pp.Trusted != nil && pp.Trusted.Contains(ip.Unmap())
+}
+
+// ProxyProtocolListener wraps a listener so that the PROXY protocol version
+// 1 or 2 headers sent by trusted sources are read off every connection
+// before anything else, including the TLS handshake. The RemoteAddr and
+// LocalAddr methods of the accepted connections return the addresses from
+// the header. When such a connection is served by a Server, the server
+// name and client certificate from the header's TLVs are used for its
+// request instead of those of the connection itself.
+//
+// Headers are read in the background so that slow sources don't hold up
+// accepting other connections, up to pp.MaxPendingHeaders at a time.
+// Connections from trusted sources that don't send a valid header in time
+// are closed.
+func ProxyProtocolListener(l net.Listener, pp *ProxyProtocol) net.Listener {
+	return &proxyListener{
+		Listener: l,
+		pp:       pp,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+}
+
+type proxyListener struct {
+	net.Listener
+	pp *ProxyProtocol
+
+	once      sync.Once
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	pl.once.Do(func() { go pl.acceptLoop() })
+
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.closed:
+		return nil, pl.err
+	}
+}
+
+func (pl *proxyListener) Close() error {
+	pl.fail(net.ErrClosed)
+	return pl.Listener.Close()
+}
+
+// fail stops the listener. Accept returns err from then on.
+func (pl *proxyListener) fail(err error) {
+	pl.closeOnce.Do(func() {
+		pl.err = err
+		close(pl.closed)
+	})
+}
+
+// acceptLoop accepts connections until the underlying listener fails and
+// reads their headers in the background. Like net/http, it backs off and
+// tries again when accepting fails temporarily, such as when the process
+// runs out of file descriptors.
+func (pl *proxyListener) acceptLoop() {
+	max := pl.pp.MaxPendingHeaders
+	if max <= 0 {
+		max = DefaultMaxPendingProxyHeaders
+	}
+	pending := make(chan struct{}, max)
+
+	var tempDelay time.Duration
+	for {
+		select {
+		case pending <- struct{}{}:
+		case <-pl.closed:
+			return
+		}
+
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			<-pending
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				log.Printf("gemini: can't accept connection: %v; retrying in %v", err, tempDelay)
+
+				t := time.NewTimer(tempDelay)
+				select {
+				case <-t.C:
+				case <-pl.closed:
+					t.Stop()
+					return
+				}
+				continue
+			}
+			pl.fail(err)
+			return
+		}
+		tempDelay = 0
+
+		go func() {
+			defer func() { <-pending }()
+
+			pconn, err := pl.readHeader(conn)
+			if err != nil {
+				log.Printf("can't read PROXY header from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+
+			select {
+			case pl.conns <- pconn:
+			case <-pl.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// readHeader reads the PROXY protocol header of conn if it comes from a
+// trusted source.
+func (pl *proxyListener) readHeader(conn net.Conn) (net.Conn, error) {
+	if !pl.pp.trusted(conn) {
+		return conn, nil
+	}
+
+	timeout := pl.pp.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pc := &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	hdr, err := readProxyHeader(pc.r)
+	if err != nil {
+		return nil, err
+	}
+	if !hdr.Source.IsZero() {
+		pc.hdr = hdr
+	}
+
+	return pc, nil
+}
+
+// proxyConn is a connection that started with a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r   *bufio.Reader
+	hdr *ProxyHeader
+}
+
+func (pc *proxyConn) Read(p []byte) (int, error) { return pc.r.Read(p) }
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	if pc.hdr == nil {
+		return pc.Conn.RemoteAddr()
+	}
+	return pc.hdr.Source.TCPAddr()
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	if pc.hdr == nil {
+		return pc.Conn.LocalAddr()
+	}
+	return pc.hdr.Destination.TCPAddr()
+}
+
+// connProxyHeader returns the PROXY protocol header conn started with, if
+// any.
+func connProxyHeader(conn net.Conn) *ProxyHeader {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		return pc.hdr
+	}
+	return nil
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header. The
+// Source of the returned header is zero if the connection wasn't proxied,
+// such as for health checks made by the load balancer itself.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(start) == "PROXY" {
+		return readProxyV1(r)
+	}
+
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+
+	return nil, ErrInvalidProxyHeader
+}
+
+// proxyV1MaxLength is the longest a version 1 header can be, including the
+// trailing CRLF.
+const proxyV1MaxLength = 107
+
+// readProxyV1 reads a human readable header such as:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 1965\r\n
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("%w: line too long", ErrInvalidProxyHeader)
+		}
+	}
+
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: line must end with CRLF", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &ProxyHeader{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, text)
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP6")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP6")
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProxyHeader{Source: src, Destination: dst}, nil
+}
+
+func parseProxyV1Addr(host, port string, is6 bool) (netaddr.IPPort, error) {
+	ip, err := netaddr.ParseIP(host)
+	if err != nil || ip.Is6() != is6 {
+		return netaddr.IPPort{}, fmt.Errorf("%w: invalid address %q", ErrInvalidProxyHeader, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netaddr.IPPort{}, fmt.Errorf("%w: invalid port %q", ErrInvalidProxyHeader, port)
+	}
+
+	return netaddr.IPPortFrom(ip, uint16(p)), nil
+}
+
+// readProxyV2 reads a binary header and the TLVs it carries.
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrInvalidProxyHeader, hdr[12]>>4)
+	}
+	command := hdr[12] & 0xf
+	family := hdr[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return &ProxyHeader{}, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", ErrInvalidProxyHeader, command)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		// UDP and unix socket addresses mean nothing to a gemini server,
+		// so those connections keep their own addresses.
+		return &ProxyHeader{}, nil
+	}
+
+	if len(body) < 2*ipLen+4 {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidProxyHeader)
+	}
+	src, _ := netaddr.FromStdIP(net.IP(body[:ipLen]))
+	dst, _ := netaddr.FromStdIP(net.IP(body[ipLen : 2*ipLen]))
+	ph := &ProxyHeader{
+		Source:      netaddr.IPPortFrom(src, binary.BigEndian.Uint16(body[2*ipLen:])),
+		Destination: netaddr.IPPortFrom(dst, binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+
+	tlvs := body[2*ipLen+4:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidProxyHeader)
+		}
+		typ, length := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidProxyHeader)
+		}
+		value := tlvs[3 : 3+length]
+		tlvs = tlvs[3+length:]
+
+		switch typ {
+		case ProxyTLVAuthority:
+			ph.ServerName = string(value)
+		case ProxyTLVClientCert:
+			cert, err := x509.ParseCertificate(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid client certificate: %v", ErrInvalidProxyHeader, err)
+			}
+			ph.Cert = cert
+			ph.CertFingerprint = Fingerprint(cert)
+		case ProxyTLVClientCertFingerprint:
+			if ph.Cert == nil {
+				ph.CertFingerprint = string(value)
+			}
+		}
+	}
+
+	return ph, nil
+}
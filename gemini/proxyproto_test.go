@@ -0,0 +1,412 @@
+package gemini
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func proxyV2Header(command, family byte, addrs []byte) string {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x07, 0xad}
+
+	for _, tt := range []struct {
+		name          string
+		input         string
+		remote        string
+		local         string
+		wantErr       bool
+		wantUnproxied bool
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1965\r\n", remote: "192.0.2.1:56324", local: "198.51.100.1:1965"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 1965\r\n", remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:1965"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\n", wantUnproxied: true},
+		{name: "v1 wrong family", input: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 1965\r\n", wantErr: true},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.1 99999 1965\r\n", wantErr: true},
+		{name: "v1 no crlf", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1965\n", wantErr: true},
+		{name: "v1 too long", input: "PROXY " + strings.Repeat("A", 200) + "\r\n", wantErr: true},
+		{name: "v2 tcp4", input: proxyV2Header(0x1, 0x11, v4), remote: "192.0.2.1:56324", local: "198.51.100.1:1965"},
+		{name: "v2 tcp4 with tlvs", input: proxyV2Header(0x1, 0x11, append(v4, 0x02, 0x00, 0x01, 'x')), remote: "192.0.2.1:56324", local: "198.51.100.1:1965"},
+		{name: "v2 local", input: proxyV2Header(0x0, 0x00, nil), wantUnproxied: true},
+		{name: "v2 short", input: proxyV2Header(0x1, 0x11, v4[:8]), wantErr: true},
+		{name: "no header", input: "gemini://localhost/\r\n", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "gemini://localhost/\r\n"))
+			hdr, err := readProxyHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("wanted an error, got: %+v", hdr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantUnproxied {
+				if !hdr.Source.IsZero() {
+					t.Fatalf("wanted no addresses, got: %v %v", hdr.Source, hdr.Destination)
+				}
+			} else if hdr.Source.String() != tt.remote || hdr.Destination.String() != tt.local {
+				t.Fatalf("wanted %s %s, got: %v %v", tt.remote, tt.local, hdr.Source, hdr.Destination)
+			}
+
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "gemini://localhost/\r\n" {
+				t.Fatalf("wanted the request to be left unread, got: %q", rest)
+			}
+		})
+	}
+}
+
+func remoteAddrServer() *Server {
+	return NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Status(StatusSuccess, "text/plain")
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+}
+
+func proxyRequest(t *testing.T, network, addr, header string) string {
+	t.Helper()
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, header+"gemini://localhost/\r\n")
+	data, _ := io.ReadAll(conn)
+	return string(data)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := remoteAddrServer()
+	go s.Serve(ProxyProtocolListener(l, &ProxyProtocol{
+		Trusted:       mustIPSet(t, "127.0.0.0/8"),
+		HeaderTimeout: 100 * time.Millisecond,
+	}))
+	t.Cleanup(func() { s.Close() })
+
+	addr := l.Addr().String()
+
+	got := proxyRequest(t, "tcp", addr, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1965\r\n")
+	if got != "20 text/plain\r\n192.0.2.1:56324" {
+		t.Fatalf("wanted the address from the header, got: %q", got)
+	}
+
+	if got := proxyRequest(t, "tcp", addr, ""); got != "" {
+		t.Fatalf("wanted a trusted source without a header to be disconnected, got: %q", got)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("wanted a silent trusted source to be disconnected, got: %v", err)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	for _, pp := range []*ProxyProtocol{
+		{Trusted: mustIPSet(t, "192.0.2.0/24")},
+		// Nothing is trusted unless it is asked for.
+		{},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := remoteAddrServer()
+		go s.Serve(ProxyProtocolListener(l, pp))
+		t.Cleanup(func() { s.Close() })
+
+		got := proxyRequest(t, "tcp", l.Addr().String(), "")
+		if !strings.HasPrefix(got, "20 text/plain\r\n127.0.0.1:") {
+			t.Fatalf("wanted an untrusted source to keep its own address, got: %q", got)
+		}
+	}
+}
+
+func TestProxyProtocolTrustAll(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := remoteAddrServer()
+	go s.Serve(ProxyProtocolListener(l, &ProxyProtocol{TrustAll: true}))
+	t.Cleanup(func() { s.Close() })
+
+	got := proxyRequest(t, "tcp", l.Addr().String(), "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1965\r\n")
+	if got != "20 text/plain\r\n192.0.2.1:56324" {
+		t.Fatalf("wanted the address from the header, got: %q", got)
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// testListener counts the connections it accepts and fails temporarily
+// failures times first.
+type testListener struct {
+	net.Listener
+	failures int32
+	accepted int32
+}
+
+func (tl *testListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&tl.failures, -1) >= 0 {
+		return nil, tempError{}
+	}
+	conn, err := tl.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&tl.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestProxyProtocolTemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := remoteAddrServer()
+	go s.Serve(ProxyProtocolListener(&testListener{Listener: l, failures: 3}, &ProxyProtocol{}))
+	t.Cleanup(func() { s.Close() })
+
+	got := proxyRequest(t, "tcp", l.Addr().String(), "")
+	if !strings.HasPrefix(got, "20 text/plain\r\n") {
+		t.Fatalf("wanted the listener to keep accepting, got: %q", got)
+	}
+}
+
+func TestProxyProtocolMaxPendingHeaders(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := &testListener{Listener: l}
+
+	s := remoteAddrServer()
+	go s.Serve(ProxyProtocolListener(tl, &ProxyProtocol{
+		Trusted:           mustIPSet(t, "127.0.0.0/8"),
+		MaxPendingHeaders: 1,
+	}))
+	t.Cleanup(func() { s.Close() })
+
+	addr := l.Addr().String()
+
+	// A silent source takes up the only slot.
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1965\r\ngemini://localhost/\r\n")
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&tl.accepted); n != 1 {
+		t.Fatalf("wanted 1 connection to be accepted, got: %d", n)
+	}
+
+	silent.Close()
+	data, _ := io.ReadAll(conn)
+	if got := string(data); got != "20 text/plain\r\n192.0.2.1:56324" {
+		t.Fatalf("wanted the second connection to be served, got: %q", got)
+	}
+}
+
+func TestServerListenUnixProxyProtocol(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gemini.sock")
+
+	s := remoteAddrServer()
+	s.ProxyProtocol = &ProxyProtocol{}
+	go s.ListenUnix(path)
+	t.Cleanup(func() { s.Close() })
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got := proxyRequest(t, "unix", path, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 1965\r\n")
+	if got != "20 text/plain\r\n[2001:db8::1]:56324" {
+		t.Fatalf("wanted the address from the header, got: %q", got)
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	cert := newTestCert(t, "client", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []ProxyHeader{
+		{
+			Source:      netaddr.MustParseIPPort("192.0.2.1:56324"),
+			Destination: netaddr.MustParseIPPort("198.51.100.1:1965"),
+			ServerName:  "example.com",
+			Cert:        leaf,
+		},
+		{
+			Source:          netaddr.MustParseIPPort("[2001:db8::1]:56324"),
+			CertFingerprint: Fingerprint(leaf),
+		},
+		{},
+	} {
+		var buf bytes.Buffer
+		if _, err := want.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := readProxyHeader(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Source != want.Source || got.ServerName != want.ServerName {
+			t.Fatalf("wanted %+v, got: %+v", want, got)
+		}
+		if want.Destination.IsZero() && !want.Source.IsZero() && !got.Destination.IP().IsUnspecified() {
+			t.Fatalf("wanted an unspecified destination, got: %v", got.Destination)
+		}
+		if want.Cert != nil && (got.Cert == nil || !got.Cert.Equal(want.Cert)) {
+			t.Fatalf("wanted the client certificate to survive, got: %v", got.Cert)
+		}
+		if want.Cert == nil && got.Cert != nil {
+			t.Fatalf("wanted no client certificate, got: %v", got.Cert)
+		}
+		fp := want.CertFingerprint
+		if want.Cert != nil {
+			fp = Fingerprint(want.Cert)
+		}
+		if got.CertFingerprint != fp {
+			t.Fatalf("wanted fingerprint %q, got: %q", fp, got.CertFingerprint)
+		}
+	}
+}
+
+func TestServerProxyHeaderIdentity(t *testing.T) {
+	cert := newTestCert(t, "client", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "gemini.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Status(StatusSuccess, "text/plain")
+		fmt.Fprintf(w, "%s %s %s %v", r.RemoteAddr, r.ServerName, r.Fingerprint(), r.Cert != nil)
+	}))
+	go s.Serve(ProxyProtocolListener(l, &ProxyProtocol{}))
+	t.Cleanup(func() { s.Close() })
+
+	for _, tt := range []struct {
+		hdr  ProxyHeader
+		want string
+	}{
+		{
+			hdr:  ProxyHeader{Source: netaddr.MustParseIPPort("192.0.2.1:56324"), ServerName: "example.com", Cert: leaf},
+			want: "192.0.2.1:56324 example.com " + Fingerprint(leaf) + " true",
+		},
+		{
+			hdr:  ProxyHeader{Source: netaddr.MustParseIPPort("192.0.2.1:56324"), CertFingerprint: "abcd"},
+			want: "192.0.2.1:56324  abcd false",
+		},
+	} {
+		var buf bytes.Buffer
+		if _, err := tt.hdr.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		got := proxyRequest(t, "unix", path, buf.String())
+		if got != "20 text/plain\r\n"+tt.want {
+			t.Fatalf("wanted %q, got: %q", tt.want, got)
+		}
+	}
+}
+
+func TestRestrictAccessProxyFingerprint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gemini.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(RestrictAccess(
+		HandlerFunc(func(w ResponseWriter, r *Request) {
+			w.Status(StatusSuccess, "text/plain")
+		}),
+		AccessRule{Prefix: "/", Authorizer: NewCertAllowlist([]string{"ABCD"}, nil, nil)},
+	))
+	go s.Serve(ProxyProtocolListener(l, &ProxyProtocol{}))
+	t.Cleanup(func() { s.Close() })
+
+	for _, tt := range []struct {
+		fingerprint string
+		want        string
+	}{
+		{fingerprint: "abcd", want: "20 text/plain\r\n"},
+		{fingerprint: "ef01", want: "61 certificate not authorised\r\n"},
+		{fingerprint: "", want: "60 client certificate required\r\n"},
+	} {
+		hdr := ProxyHeader{Source: netaddr.MustParseIPPort("192.0.2.1:56324"), CertFingerprint: tt.fingerprint}
+		var buf bytes.Buffer
+		if _, err := hdr.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := proxyRequest(t, "unix", path, buf.String()); got != tt.want {
+			t.Fatalf("wanted %q, got: %q", tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package gemini
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rateLimitedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gemini_rate_limited_total",
+	Help: "The number of gemini requests answered with 44 SLOW DOWN",
+}, []string{"domain"})
+
+// DefaultMaxRateLimitClients is the number of clients a RateLimiter keeps
+// track of when MaxClients is not set.
+const DefaultMaxRateLimitClients = 10000
+
+// RateLimiter is a token bucket rate limiter that gives every client its
+// own bucket. Clients are identified by their IP address, with IPv6
+// addresses grouped by prefix, and optionally by their client certificate
+// as well.
+//
+// Only the MaxClients most recently seen clients are remembered, so memory
+// use stays bounded no matter how many addresses a client uses.
+type RateLimiter struct {
+	// Rate is the number of requests per second a client may make on
+	// average. If it isn't positive, buckets never refill.
+	Rate float64
+
+	// Burst is the number of requests a client may make at once.
+	Burst int
+
+	// IPv6Prefix is the prefix length IPv6 addresses are grouped by, since
+	// a single client often controls a whole /64. Zero means 64.
+	IPv6Prefix uint8
+
+	// ByCertificate gives clients that present a certificate a bucket for
+	// its fingerprint too, which limits them across all of their
+	// addresses. The bucket of their address still applies, so that new
+	// certificates don't get a client new tokens.
+	ByCertificate bool
+
+	// MaxClients is the number of clients to keep track of. Zero means
+	// DefaultMaxRateLimitClients.
+	MaxClients int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a rate limiter allowing rate requests per second
+// with bursts of up to burst requests. It panics if rate is not positive.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if !(rate > 0) {
+		panic("gemini: non-positive rate for NewRateLimiter")
+	}
+	return &RateLimiter{Rate: rate, Burst: burst}
+}
+
+// Keys returns the keys of the buckets of the client that made r: one for
+// its address and, with ByCertificate, one for its certificate. It returns
+// none if the client can't be identified, such as for requests served over
+// unix sockets without a certificate.
+func (rl *RateLimiter) Keys(r *Request) []string {
+	var keys []string
+	if key := rl.addrKey(r); key != "" {
+		keys = append(keys, key)
+	}
+	if fp := r.Fingerprint(); rl.ByCertificate && fp != "" {
+		keys = append(keys, "cert:"+fp)
+	}
+	return keys
+}
+
+func (rl *RateLimiter) addrKey(r *Request) string {
+	ip := r.RemoteAddr.IP().Unmap()
+	if ip.IsZero() {
+		return ""
+	}
+	if ip.Is6() {
+		bits := rl.IPv6Prefix
+		if bits == 0 {
+			bits = 64
+		}
+		p, err := ip.Prefix(bits)
+		if err == nil {
+			return p.String()
+		}
+	}
+	return ip.String()
+}
+
+// Allow takes a token from each of the buckets identified by keys. If any
+// of them is empty, none is taken from and it returns false and how long
+// the client has to wait until its next request is allowed.
+func (rl *RateLimiter) Allow(keys ...string) (bool, time.Duration) {
+	return rl.allowAt(time.Now(), keys...)
+}
+
+func (rl *RateLimiter) allowAt(now time.Time, keys ...string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.buckets == nil {
+		rl.buckets = map[string]*list.Element{}
+	}
+
+	var wait time.Duration
+	buckets := make([]*bucket, len(keys))
+	for i, key := range keys {
+		b := rl.bucketLocked(key, now)
+		if b.tokens < 1 {
+			if w := rl.waitFor(b); w > wait {
+				wait = w
+			}
+		}
+		buckets[i] = b
+	}
+	// Evicting only now keeps the buckets of this call from pushing each
+	// other out.
+	rl.evictLocked(len(keys))
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// waitFor returns how long it takes b to get a whole token again.
+func (rl *RateLimiter) waitFor(b *bucket) time.Duration {
+	if !(rl.Rate > 0) {
+		return math.MaxInt64
+	}
+	return time.Duration((1 - b.tokens) / rl.Rate * float64(time.Second))
+}
+
+// bucketLocked returns the bucket for key, refilled up to now. rl.mu must
+// be held.
+func (rl *RateLimiter) bucketLocked(key string, now time.Time) *bucket {
+	if e, ok := rl.buckets[key]; ok {
+		rl.lru.MoveToFront(e)
+		b := e.Value.(*bucket)
+		if rl.Rate > 0 {
+			b.tokens = math.Min(float64(rl.Burst), b.tokens+now.Sub(b.last).Seconds()*rl.Rate)
+		}
+		b.last = now
+		return b
+	}
+
+	b := &bucket{key: key, tokens: float64(rl.Burst), last: now}
+	rl.buckets[key] = rl.lru.PushFront(b)
+	return b
+}
+
+// evictLocked forgets the least recently seen clients until at most
+// MaxClients are left. The keep most recently seen buckets are never
+// forgotten. rl.mu must be held.
+func (rl *RateLimiter) evictLocked(keep int) {
+	max := rl.MaxClients
+	if max <= 0 {
+		max = DefaultMaxRateLimitClients
+	}
+	if max < keep {
+		max = keep
+	}
+
+	for rl.lru.Len() > max {
+		e := rl.lru.Back()
+		rl.lru.Remove(e)
+		delete(rl.buckets, e.Value.(*bucket).key)
+	}
+}
+
+// RateLimit wraps a handler so that clients making requests faster than
+// rl allows are answered with StatusSlowDown. The meta field holds the
+// number of seconds the client must wait, as the specification requires.
+func RateLimit(h Handler, rl *RateLimiter) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		keys := rl.Keys(r)
+		if len(keys) == 0 {
+			h.HandleGemini(w, r)
+			return
+		}
+
+		ok, wait := rl.Allow(keys...)
+		if !ok {
+			rateLimitedCount.With(prometheus.Labels{"domain": r.URL.Hostname()}).Inc()
+			secs := int(math.Ceil(wait.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Status(StatusSlowDown, strconv.Itoa(secs))
+			return
+		}
+
+		h.HandleGemini(w, r)
+	})
+}
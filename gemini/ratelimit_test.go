@@ -0,0 +1,158 @@
+package gemini
+
+import (
+	"crypto/x509"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini/geminitest"
+	"inet.af/netaddr"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := NewRateLimiter(1, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allowAt(now, "client"); !ok {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+
+	ok, wait := rl.allowAt(now, "client")
+	if ok {
+		t.Fatal("request over the burst was allowed")
+	}
+	if wait != time.Second {
+		t.Fatalf("wanted to wait 1s, got: %v", wait)
+	}
+
+	if ok, _ := rl.allowAt(now, "other"); !ok {
+		t.Fatal("another client was refused")
+	}
+
+	if ok, _ := rl.allowAt(now.Add(time.Second), "client"); !ok {
+		t.Fatal("request after refill was refused")
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	rl := NewRateLimiter(1, 1)
+	rl.MaxClients = 2
+	now := time.Now()
+
+	for _, key := range []string{"a", "b", "c"} {
+		rl.allowAt(now, key)
+	}
+
+	if len(rl.buckets) != 2 {
+		t.Fatalf("wanted 2 remembered clients, got: %d", len(rl.buckets))
+	}
+	if _, ok := rl.buckets["a"]; ok {
+		t.Fatal("least recently seen client was not forgotten")
+	}
+}
+
+func TestRateLimiterMaxClientsSameCall(t *testing.T) {
+	rl := NewRateLimiter(1, 1)
+	rl.MaxClients = 1
+	now := time.Now()
+
+	if ok, _ := rl.allowAt(now, "addr", "cert"); !ok {
+		t.Fatal("first request was refused")
+	}
+	if ok, _ := rl.allowAt(now, "addr", "cert"); ok {
+		t.Fatal("wanted the buckets of one request not to evict each other")
+	}
+}
+
+func TestRateLimiterZeroRate(t *testing.T) {
+	rl := &RateLimiter{Burst: 1}
+	now := time.Now()
+
+	if ok, _ := rl.allowAt(now, "client"); !ok {
+		t.Fatal("request within the burst was refused")
+	}
+	if ok, wait := rl.allowAt(now.Add(time.Hour), "client"); ok || wait <= 0 {
+		t.Fatalf("wanted the bucket never to refill, got: %v %v", ok, wait)
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	cert := newTestCert(t, "client", time.Now().Add(-time.Hour), time.Now().Add(time.Hour)).Leaf
+
+	for _, tt := range []struct {
+		name string
+		rl   *RateLimiter
+		r    *Request
+		want []string
+	}{
+		{name: "ipv4", rl: &RateLimiter{}, r: &Request{RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:1965")}, want: []string{"192.0.2.1"}},
+		{name: "ipv6 default prefix", rl: &RateLimiter{}, r: &Request{RemoteAddr: netaddr.MustParseIPPort("[2001:db8:1:2:3::4]:1965")}, want: []string{"2001:db8:1:2::/64"}},
+		{name: "ipv6 custom prefix", rl: &RateLimiter{IPv6Prefix: 48}, r: &Request{RemoteAddr: netaddr.MustParseIPPort("[2001:db8:1:2:3::4]:1965")}, want: []string{"2001:db8:1::/48"}},
+		{name: "unix socket", rl: &RateLimiter{}, r: &Request{}, want: nil},
+		{name: "certificate", rl: &RateLimiter{ByCertificate: true}, r: &Request{Cert: cert, RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:1965")}, want: []string{"192.0.2.1", "cert:" + Fingerprint(cert)}},
+		{name: "certificate over unix socket", rl: &RateLimiter{ByCertificate: true}, r: &Request{Cert: cert}, want: []string{"cert:" + Fingerprint(cert)}},
+		{name: "forwarded fingerprint", rl: &RateLimiter{ByCertificate: true}, r: &Request{fingerprint: "abcd", RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:1965")}, want: []string{"192.0.2.1", "cert:abcd"}},
+		{name: "certificate ignored", rl: &RateLimiter{}, r: &Request{Cert: cert, RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:1965")}, want: []string{"192.0.2.1"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rl.Keys(tt.r); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("wanted keys %q, got: %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRateLimitByCertificate(t *testing.T) {
+	rl := NewRateLimiter(0.1, 1)
+	rl.ByCertificate = true
+	h := RateLimit(NotFound(), rl)
+	u, _ := url.Parse("gemini://localhost/")
+
+	do := func(addr string, cert *x509.Certificate) int {
+		rw := new(geminitest.ResponseRecorder)
+		h.HandleGemini(rw, &Request{URL: u, Cert: cert, RemoteAddr: netaddr.MustParseIPPort(addr)})
+		return rw.StatusCode
+	}
+	newCert := func() *x509.Certificate {
+		return newTestCert(t, "client", time.Now().Add(-time.Hour), time.Now().Add(time.Hour)).Leaf
+	}
+
+	cert := newCert()
+	if got := do("192.0.2.1:1965", cert); got != StatusNotFound {
+		t.Fatalf("wanted first request to pass, got: %d", got)
+	}
+	if got := do("192.0.2.1:1965", newCert()); got != StatusSlowDown {
+		t.Fatalf("wanted a new certificate not to get around the limit, got: %d", got)
+	}
+	if got := do("192.0.2.2:1965", cert); got != StatusSlowDown {
+		t.Fatalf("wanted a new address not to get around the limit, got: %d", got)
+	}
+	if got := do("192.0.2.3:1965", nil); got != StatusNotFound {
+		t.Fatalf("wanted another client to pass, got: %d", got)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := RateLimit(NotFound(), NewRateLimiter(0.1, 1))
+	u, _ := url.Parse("gemini://localhost/")
+	r := &Request{URL: u, RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:1965")}
+
+	rw := new(geminitest.ResponseRecorder)
+	h.HandleGemini(rw, r)
+	if rw.StatusCode != StatusNotFound {
+		t.Fatalf("wanted first request to pass, got: %d", rw.StatusCode)
+	}
+
+	rw = new(geminitest.ResponseRecorder)
+	h.HandleGemini(rw, r)
+	if rw.StatusCode != StatusSlowDown {
+		t.Fatalf("wanted status code %d, got: %d", StatusSlowDown, rw.StatusCode)
+	}
+	if rw.Meta != "10" {
+		t.Fatalf("wanted to be told to wait 10 seconds, got: %q", rw.Meta)
+	}
+}
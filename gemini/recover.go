@@ -0,0 +1,117 @@
+package gemini
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"within.website/ln"
+)
+
+var panicCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gemini_handler_panics_total",
+	Help: "The number of gemini handlers that panicked",
+}, []string{"domain"})
+
+// ErrAbortHandler is a sentinel panic value to abort a handler. The Server
+// resets the connection without finishing the TLS session, so the client
+// can tell the response is incomplete, and doesn't log the panic. Like any
+// other panic, it crashes the program if DisablePanicRecovery is set.
+var ErrAbortHandler = errors.New("gemini: abort Handler")
+
+// CGIHandler marks h as a handler that runs external programs or talks to
+// other servers on behalf of the client. If h panics before sending a
+// status line, the Server answers with StatusCGIError instead of
+// StatusTemporaryFailure.
+func CGIHandler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == ErrAbortHandler {
+					panic(p)
+				}
+				panic(cgiPanic{val: p, stack: debug.Stack()})
+			}
+		}()
+		h.HandleGemini(w, r)
+	})
+}
+
+// cgiPanic carries a panic out of a CGIHandler along with the stack where
+// it originally happened.
+type cgiPanic struct {
+	val   interface{}
+	stack []byte
+}
+
+// recoverHandler is deferred around handling a connection. It logs any
+// panic, tells the client about it if it can and lets the connection be
+// closed normally.
+func (s *Server) recoverHandler(ctx context.Context, conn net.Conn, cw *connWrapper) {
+	p := recover()
+	if p == nil {
+		return
+	}
+
+	if p == ErrAbortHandler {
+		abortConn(conn)
+		return
+	}
+
+	status := StatusTemporaryFailure
+	stack := debug.Stack()
+	if cp, ok := p.(cgiPanic); ok {
+		status = StatusCGIError
+		p = cp.val
+		stack = cp.stack
+	}
+
+	panicCount.With(prometheus.Labels{"domain": cw.domain}).Inc()
+
+	ln.Error(ctx, fmt.Errorf("gemini: panic serving %s: %v", conn.RemoteAddr().String(), p), ln.F{
+		"domain": cw.domain,
+		"stack":  string(stack),
+	})
+
+	if cw.status == 0 {
+		cw.Status(status, "internal server error")
+	}
+}
+
+// reportPanic logs and counts a panic of a handler that can't be recovered
+// by the Server anymore, such as one that timed out.
+func reportPanic(r *Request, p interface{}, stack []byte) {
+	if p == ErrAbortHandler {
+		return
+	}
+
+	domain := r.URL.Hostname()
+	panicCount.With(prometheus.Labels{"domain": domain}).Inc()
+
+	ln.Error(r.Context(), fmt.Errorf("gemini: panic serving %s after it timed out: %v", r.URL, p), ln.F{
+		"domain": domain,
+		"stack":  string(stack),
+	})
+}
+
+// abortConn closes conn so that the client sees an error instead of the end
+// of the response: TCP connections are reset, and TLS connections don't get
+// the close_notify alert that would make a cut off body look complete.
+func abortConn(conn net.Conn) {
+	nc := conn
+	if tc, ok := conn.(*tls.Conn); ok {
+		nc = tc.NetConn()
+	}
+	if pc, ok := nc.(*proxyConn); ok {
+		nc = pc.Conn
+	}
+	if tc, ok := nc.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	nc.Close()
+}
@@ -0,0 +1,117 @@
+package gemini
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerRecoversPanics(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    Handler
+		want string
+	}{
+		{
+			name: "plain handler",
+			h: HandlerFunc(func(w ResponseWriter, r *Request) {
+				panic("oh no")
+			}),
+			want: "40 internal server error\r\n",
+		},
+		{
+			name: "cgi handler",
+			h: CGIHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+				panic("oh no")
+			})),
+			want: "42 internal server error\r\n",
+		},
+		{
+			name: "status already sent",
+			h: HandlerFunc(func(w ResponseWriter, r *Request) {
+				w.Status(StatusSuccess, "text/plain")
+				w.Status(StatusSuccess, "text/plain")
+			}),
+			want: "20 text/plain\r\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := NewServer(tt.h)
+			go s.Serve(l)
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprint(conn, "gemini://localhost/\r\n")
+
+			data, err := io.ReadAll(bufio.NewReader(conn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("wanted %q, got: %q", tt.want, data)
+			}
+		})
+	}
+}
+
+func TestServerAbortsHandler(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		wrap func(Handler) Handler
+	}{
+		{name: "plain handler", wrap: func(h Handler) Handler { return h }},
+		{name: "cgi handler", wrap: CGIHandler},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sent := make(chan struct{})
+			s := NewServer(tt.wrap(HandlerFunc(func(w ResponseWriter, r *Request) {
+				w.Status(StatusSuccess, "text/plain")
+				w.Write([]byte("partial"))
+				<-sent
+				panic(ErrAbortHandler)
+			})))
+			go s.Serve(l)
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprint(conn, "gemini://localhost/\r\n")
+
+			br := bufio.NewReader(conn)
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != "20 text/plain\r\n" {
+				t.Fatalf("wanted a success header, got: %q", line)
+			}
+			close(sent)
+
+			if _, err := io.ReadAll(br); err == nil {
+				t.Fatal("wanted the aborted response to end with an error")
+			}
+		})
+	}
+}
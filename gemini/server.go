@@ -2,8 +2,10 @@ package gemini
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +13,9 @@ import (
 	"net/textproto"
 	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Xe/rhea/limitwriter"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,12 +28,90 @@ var requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "The number of gemini requests handled",
 }, []string{"domain", "status"})
 
+// ErrServerClosed is returned by the Server's Serve, ListenAndServe and
+// ListenUnix methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("gemini: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks for connections that
+// have finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
 // Server is a gemini server struct in the vein of net/http#Server.
 type Server struct {
-	lis net.Listener
 	hdl Handler
+
+	// BaseContext optionally specifies a function that returns the base
+	// context for incoming requests on this server. The provided Listener
+	// is the specific Listener that's about to start accepting requests.
+	// If BaseContext is nil, the default is context.Background(). If
+	// non-nil, it must return a non-nil context.
+	BaseContext func(net.Listener) context.Context
+
+	// HandshakeTimeout is the maximum amount of time a client has to
+	// complete the TLS handshake. Zero means the handshake is covered by
+	// ReadTimeout instead.
+	HandshakeTimeout time.Duration
+
+	// ReadTimeout is the maximum amount of time a client has to send the
+	// request line after the connection is accepted (or after the TLS
+	// handshake completes when HandshakeTimeout is set). Zero means no
+	// timeout.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the maximum amount of time the whole response may
+	// take to be written once the request line has been read. Zero means
+	// no timeout.
+	WriteTimeout time.Duration
+
+	// DisablePanicRecovery lets panics in handlers crash the program
+	// instead of being logged and answered with an error status. This is
+	// mostly useful in tests.
+	DisablePanicRecovery bool
+
+	// MaxConnections is the maximum number of connections open at once.
+	// When it is reached, no more connections are accepted until one
+	// closes. Zero means no limit.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the maximum number of connections a single
+	// IP address may have open at once. Connections over the limit are
+	// answered with StatusSlowDown. Zero means no limit.
+	MaxConnectionsPerIP int
+
+	// ProxyProtocol makes ListenAndServe and ListenUnix read PROXY protocol
+	// headers off incoming connections so requests get the address of the
+	// real client. Servers using Serve with their own listener should wrap
+	// it with ProxyProtocolListener instead.
+	ProxyProtocol *ProxyProtocol
+
+	inShutdown atomic.Bool
+
+	mu        sync.Mutex
+	listeners map[*net.Listener]struct{}
+	conns     map[net.Conn]*trackedConn
+	done      chan struct{}
+	connSem   chan struct{}
+	perIP     map[netaddr.IP]int
+}
+
+// trackedConn is the bookkeeping the Server keeps for every open
+// connection.
+type trackedConn struct {
+	state  connState
+	cancel context.CancelFunc
 }
 
+// connState tracks what a connection is doing so Shutdown knows which
+// connections can be closed right away.
+type connState int
+
+const (
+	// stateNew is a connection that has not yet sent its request line.
+	stateNew connState = iota
+	// stateActive is a connection whose request is being handled.
+	stateActive
+)
+
 // NewServer creates a new Gemini server based on a particular handler.
 func NewServer(hdl Handler) *Server {
 	return &Server{
@@ -40,18 +123,25 @@ func NewServer(hdl Handler) *Server {
 // and key. This is most useful for serving a single site. If you need more control or
 // want to host multiple sites, create your own tls.Listener and use the Serve method.
 func (s *Server) ListenAndServe(addr string, certPath string, keyPath string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
 	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
 	if err != nil {
 		return err
 	}
 
 	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
-	lis, err := tls.Listen("tcp", addr, cfg)
+	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	if s.ProxyProtocol != nil {
+		lis = ProxyProtocolListener(lis, s.ProxyProtocol)
+	}
 
-	return s.Serve(lis)
+	return s.Serve(tls.NewListener(lis, cfg))
 }
 
 // ListenUnix listens on a unix domain socket at the given path. It will automatically
@@ -60,35 +150,299 @@ func (s *Server) ListenAndServe(addr string, certPath string, keyPath string) er
 // This can be useful when hosting multiple gemini apps on the same host without having
 // them each care about their TLS configuration.
 func (s *Server) ListenUnix(path string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
 	os.Remove(path)
 	lis, err := net.Listen("unix", path)
 	if err != nil {
 		return fmt.Errorf("net.Listen(\"unix\", %q): %v", path, err)
 	}
+	if s.ProxyProtocol != nil {
+		lis = ProxyProtocolListener(lis, s.ProxyProtocol)
+	}
 
 	return s.Serve(lis)
 }
 
 // Serve serves gemini responses to clients connecting to this Listener.
+//
+// Serve always returns a non-nil error and closes lis. After Shutdown or
+// Close, the returned error is ErrServerClosed.
 func (s *Server) Serve(lis net.Listener) error {
-	if s.lis != nil {
-		return fmt.Errorf("listener already set")
+	baseCtx := context.Background()
+	if s.BaseContext != nil {
+		baseCtx = s.BaseContext(lis)
+		if baseCtx == nil {
+			panic("gemini: BaseContext returned a nil context")
+		}
 	}
 
+	lis = &onceCloseListener{Listener: lis}
+	defer lis.Close()
+
+	if !s.trackListener(&lis, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(&lis, false)
+
 	for {
+		if !s.acquireConnSlot() {
+			return ErrServerClosed
+		}
+
 		conn, err := lis.Accept()
 		if err != nil {
+			s.releaseConnSlot()
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(baseCtx)
+		if !s.trackConn(conn, cancel) {
+			s.releaseConnSlot()
+			cancel()
+			conn.Close()
+			continue
+		}
+
+		go s.handle(ctx, conn)
+	}
+}
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active connections. Shutdown works by first closing all open listeners,
+// then closing all connections that have not sent their request yet, and
+// then waiting indefinitely for handlers to return and their connections
+// to close.
+//
+// If the provided context expires before the shutdown is complete, the
+// contexts of all requests still in flight are cancelled and Shutdown
+// returns the context's error. Otherwise it returns any error
+// returned from closing the Server's underlying Listener(s).
+//
+// Once Shutdown has been called on a server, it may not be reused; future
+// calls to methods such as Serve will return ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	s.closeDoneChanLocked()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeNewConns() {
 			return err
 		}
+		select {
+		case <-ctx.Done():
+			s.cancelRequests()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all active listeners and connections. Handlers
+// that are still running will have their request contexts cancelled and
+// will see write errors.
+//
+// For a graceful shutdown, use Shutdown.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
 
-		go s.handle(conn)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeDoneChanLocked()
+	err := s.closeListenersLocked()
+	for conn, tc := range s.conns {
+		tc.cancel()
+		conn.Close()
+		delete(s.conns, conn)
+		activeConnections.Dec()
 	}
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
 }
 
-func (s *Server) handle(conn net.Conn) {
+func (s *Server) getDoneChanLocked() chan struct{} {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+func (s *Server) closeDoneChanLocked() {
+	ch := s.getDoneChanLocked()
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for lis := range s.listeners {
+		if cerr := (*lis).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeNewConns closes all connections that have not yet sent a request
+// and reports whether there are no connections left.
+func (s *Server) closeNewConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, tc := range s.conns {
+		if tc.state == stateNew {
+			tc.cancel()
+			conn.Close()
+			delete(s.conns, conn)
+			activeConnections.Dec()
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// cancelRequests cancels the contexts of all requests in flight.
+func (s *Server) cancelRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tc := range s.conns {
+		tc.cancel()
+	}
+}
+
+// trackListener adds or removes a listener from the set of tracked
+// listeners. It reports false when adding a listener to a server that is
+// shutting down.
+func (s *Server) trackListener(lis *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[lis] = struct{}{}
+	} else {
+		delete(s.listeners, lis)
+	}
+	return true
+}
+
+// trackConn adds a connection to the set of tracked connections. cancel
+// cancels the context of the connection's request. It reports false when
+// the server is shutting down.
+func (s *Server) trackConn(conn net.Conn, cancel context.CancelFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown() {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*trackedConn)
+	}
+	s.conns[conn] = &trackedConn{state: stateNew, cancel: cancel}
+	activeConnections.Inc()
+	return true
+}
+
+// untrackConn removes a connection from the set of tracked connections and
+// cancels its request context.
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tc, ok := s.conns[conn]; ok {
+		tc.cancel()
+		delete(s.conns, conn)
+		activeConnections.Dec()
+	}
+}
+
+// setActive marks a connection as having started to handle its request.
+// It reports false if the connection was already closed by Shutdown or
+// Close.
+func (s *Server) setActive(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tc, ok := s.conns[conn]
+	if !ok {
+		return false
+	}
+	tc.state = stateActive
+	return true
+}
+
+// onceCloseListener wraps a net.Listener, protecting it from multiple
+// Close calls.
+type onceCloseListener struct {
+	net.Listener
+	once     sync.Once
+	closeErr error
+}
+
+func (oc *onceCloseListener) Close() error {
+	oc.once.Do(func() { oc.closeErr = oc.Listener.Close() })
+	return oc.closeErr
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	defer s.releaseConnSlot()
+	defer s.untrackConn(conn)
 	defer conn.Close()
 
 	cw := &connWrapper{Writer: limitwriter.New(conn, 4*1024*1024)}
+
+	if !s.DisablePanicRecovery {
+		defer s.recoverHandler(ctx, conn, cw)
+	}
+
+	overLimit := false
+	if ip, ok := connIP(conn); ok && s.MaxConnectionsPerIP > 0 {
+		if s.acquireIP(ip) {
+			defer s.releaseIP(ip)
+		} else {
+			overLimit = true
+		}
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok && s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+		if err := tc.HandshakeContext(ctx); err != nil {
+			log.Printf("TLS handshake error from %s: %v", conn.RemoteAddr().String(), err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	if s.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+
 	r := bufio.NewReader(io.LimitReader(conn, 1024))
 	tpr := textproto.NewReader(r)
 	uText, err := tpr.ReadLine()
@@ -98,6 +452,19 @@ func (s *Server) handle(conn net.Conn) {
 		return
 	}
 
+	conn.SetReadDeadline(time.Time{})
+	if s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+
+	// The request is read before answering so the client doesn't get a
+	// reset instead of the response.
+	if overLimit {
+		connLimitedCount.Inc()
+		cw.Status(StatusSlowDown, "1")
+		return
+	}
+
 	u, err := url.Parse(uText)
 	if err != nil {
 		log.Printf("can't read url from %s: %v", conn.RemoteAddr().String(), err)
@@ -113,6 +480,7 @@ func (s *Server) handle(conn net.Conn) {
 
 	req := &Request{
 		URL: u,
+		ctx: ctx,
 	}
 
 	if conn.RemoteAddr().Network() != "unix" {
@@ -120,19 +488,108 @@ func (s *Server) handle(conn net.Conn) {
 	}
 
 	if tc, ok := conn.(*tls.Conn); ok {
-		if certs := tc.ConnectionState().PeerCertificates; len(certs) != 0 {
-			req.Cert = certs[0]
+		state := tc.ConnectionState()
+		req.ServerName = state.ServerName
+		if len(state.PeerCertificates) != 0 {
+			req.Cert = state.PeerCertificates[0]
 		}
 	}
 
+	// A proxy in front of the server speaks for the client, so its own TLS
+	// identity, if any, doesn't belong to the request.
+	if hdr := connProxyHeader(conn); hdr != nil {
+		req.ServerName = hdr.ServerName
+		req.Cert = hdr.Cert
+		req.fingerprint = hdr.CertFingerprint
+	}
+
+	if req.Cert != nil {
+		now := time.Now()
+		if now.Before(req.Cert.NotBefore) || now.After(req.Cert.NotAfter) {
+			cw.Status(StatusCertificateNotValid, "certificate is not valid at this time")
+			return
+		}
+	}
+
+	if !s.setActive(conn) {
+		return
+	}
+
+	// Clients don't send anything after the request line, so a finished
+	// read means the client went away.
+	go func() {
+		conn.Read(make([]byte, 1))
+		s.cancelConn(conn)
+	}()
+
 	s.hdl.HandleGemini(cw, req)
 }
 
+// cancelConn cancels the request context of a tracked connection.
+func (s *Server) cancelConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tc, ok := s.conns[conn]; ok {
+		tc.cancel()
+	}
+}
+
 // Request contains all relevant metadata for a gemini request.
 type Request struct {
 	URL        *url.URL
 	Cert       *x509.Certificate
 	RemoteAddr netaddr.IPPort
+
+	// ServerName is the server name the client asked for with SNI, if it
+	// used TLS.
+	ServerName string
+
+	ctx context.Context
+
+	// fingerprint is the client certificate fingerprint a proxy sent
+	// without the certificate itself.
+	fingerprint string
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the client certificate as
+// returned by the package-level Fingerprint function, or an empty string
+// if the client didn't present a certificate. For requests forwarded by a
+// proxy that only sent the fingerprint of the certificate, Cert is nil but
+// Fingerprint still returns it.
+func (r *Request) Fingerprint() string {
+	if r.Cert == nil {
+		return r.fingerprint
+	}
+	return Fingerprint(r.Cert)
+}
+
+// Context returns the request's context. To change the context, use
+// WithContext.
+//
+// The returned context is always non-nil; it defaults to the background
+// context.
+//
+// For incoming server requests, the context is canceled when the client's
+// connection closes, when the handler returns or when the server is
+// closed.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+// The provided ctx must be non-nil.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
 }
 
 // ResponseWriter is used by a gemini handler to construct a gemini response.
@@ -0,0 +1,228 @@
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		close(started)
+		<-release
+		w.Status(StatusSuccess, "text/plain")
+		fmt.Fprint(w, "done")
+	}))
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "gemini://localhost/\r\n")
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+
+	if err := <-serveErr; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("wanted ErrServerClosed from Serve, got: %v", err)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the handler finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	data, err := io.ReadAll(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "20 text/plain\r\ndone" {
+		t.Fatalf("wanted full response, got: %q", data)
+	}
+
+	if err := s.Serve(l); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("wanted ErrServerClosed after shutdown, got: %v", err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		close(started)
+		<-release
+	}))
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "gemini://localhost/\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wanted context.DeadlineExceeded, got: %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestRequestContextCancelledOnDisconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	s := NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "gemini://localhost/\r\n")
+	<-started
+	conn.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request context was not cancelled after the client disconnected")
+	}
+}
+
+func TestRequestWithContext(t *testing.T) {
+	r := &Request{}
+	if r.Context() != context.Background() {
+		t.Fatal("wanted the background context for a bare request")
+	}
+
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	r2 := r.WithContext(ctx)
+	if r2 == r {
+		t.Fatal("WithContext must return a copy")
+	}
+	if r2.Context().Value(key{}) != "value" {
+		t.Fatal("WithContext did not set the context")
+	}
+	if r.Context() != context.Background() {
+		t.Fatal("WithContext modified the original request")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	now := time.Now()
+	serverCert := newTestCert(t, "localhost", now.Add(-time.Hour), now.Add(time.Hour))
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(RequireCert(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Status(StatusSuccess, "text/plain")
+		fmt.Fprint(w, r.Fingerprint())
+	})))
+	go s.Serve(l)
+	defer s.Close()
+
+	u := "gemini://" + l.Addr().String() + "/"
+
+	t.Run("no certificate", func(t *testing.T) {
+		resp, err := Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Status != StatusClientCertificateRequired {
+			t.Fatalf("wanted status code %d, got: %d", StatusClientCertificateRequired, resp.Status)
+		}
+	})
+
+	t.Run("valid certificate", func(t *testing.T) {
+		cert := newTestCert(t, "client", now.Add(-time.Hour), now.Add(time.Hour))
+		c := &Client{Certificate: &cert}
+		resp, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Status != StatusSuccess {
+			t.Fatalf("wanted status code %d, got: %d", StatusSuccess, resp.Status)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != Fingerprint(cert.Leaf) {
+			t.Fatalf("wanted fingerprint %s, got: %s", Fingerprint(cert.Leaf), body)
+		}
+	})
+
+	t.Run("expired certificate", func(t *testing.T) {
+		cert := newTestCert(t, "client", now.Add(-2*time.Hour), now.Add(-time.Hour))
+		c := &Client{Certificate: &cert}
+		resp, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Status != StatusCertificateNotValid {
+			t.Fatalf("wanted status code %d, got: %d", StatusCertificateNotValid, resp.Status)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrHandlerTimeout is returned on ResponseWriter Write calls in handlers
+// which have timed out.
+var ErrHandlerTimeout = errors.New("gemini: Handler timeout")
+
+// TimeoutHandler returns a Handler that runs h with the given time limit.
+//
+// The new Handler calls h.HandleGemini to handle each request, but if a
+// call runs for longer than its time limit and h has not sent a status line
+// yet, the handler responds with StatusTemporaryFailure and the given
+// message in its meta. If msg is empty, a suitable default message will be
+// sent. After such a timeout, or if h runs out of time while streaming a
+// response body, writes by h to its ResponseWriter will return
+// ErrHandlerTimeout.
+//
+// The request context passed to h is cancelled when the time limit is
+// reached.
+func TimeoutHandler(h Handler, dt time.Duration, msg string) Handler {
+	if msg == "" {
+		msg = "handler timed out"
+	}
+	return &timeoutHandler{
+		handler: h,
+		dt:      dt,
+		msg:     msg,
+	}
+}
+
+type timeoutHandler struct {
+	handler Handler
+	dt      time.Duration
+	msg     string
+}
+
+func (th *timeoutHandler) HandleGemini(w ResponseWriter, r *Request) {
+	parent := r.Context()
+	ctx, cancel := context.WithTimeout(parent, th.dt)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	tw := &timeoutWriter{w: w, ctx: ctx}
+	done := make(chan struct{})
+	panicChan := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				if tw.timedOut {
+					// Nobody is waiting for h anymore.
+					reportPanic(r, p, debug.Stack())
+					return
+				}
+				panicChan <- p
+			}
+		}()
+		th.handler.HandleGemini(tw, r)
+		close(done)
+	}()
+
+	select {
+	case p := <-panicChan:
+		panic(p)
+	case <-done:
+	case <-ctx.Done():
+		tw.mu.Lock()
+		defer tw.mu.Unlock()
+		tw.timedOut = true
+
+		select {
+		case p := <-panicChan:
+			panic(p)
+		default:
+		}
+
+		// If the client went away or the server is shutting down, there
+		// is nobody to tell about the timeout.
+		if !tw.wroteStatus && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			w.Status(StatusTemporaryFailure, th.msg)
+		}
+	}
+}
+
+// timeoutWriter guards a ResponseWriter so that a handler that outlives its
+// time limit can't touch it anymore.
+type timeoutWriter struct {
+	w   ResponseWriter
+	ctx context.Context
+
+	mu          sync.Mutex
+	timedOut    bool
+	wroteStatus bool
+}
+
+func (tw *timeoutWriter) Status(status int, meta string) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return
+	}
+	tw.wroteStatus = true
+	tw.w.Status(status, meta)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return 0, ErrHandlerTimeout
+	}
+	return tw.w.Write(p)
+}
+
+// expired reports whether the handler ran out of time. The context is
+// checked too so that a handler reacting to its cancellation can't race
+// TimeoutHandler into writing. tw.mu must be held.
+func (tw *timeoutWriter) expired() bool {
+	if !tw.timedOut && tw.ctx.Err() != nil {
+		tw.timedOut = true
+	}
+	return tw.timedOut
+}
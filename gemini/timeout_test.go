@@ -0,0 +1,141 @@
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini/geminitest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	u, err := url.Parse("gemini://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("fast handler", func(t *testing.T) {
+		h := TimeoutHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+			w.Status(StatusSuccess, "text/plain")
+			fmt.Fprint(w, "hi")
+		}), time.Second, "")
+
+		rw := new(geminitest.ResponseRecorder)
+		h.HandleGemini(rw, &Request{URL: u})
+
+		if rw.StatusCode != StatusSuccess {
+			t.Fatalf("wanted status code %d, got: %d", StatusSuccess, rw.StatusCode)
+		}
+		if rw.Body.String() != "hi" {
+			t.Fatalf("wanted body %q, got: %q", "hi", rw.Body.String())
+		}
+	})
+
+	t.Run("slow handler", func(t *testing.T) {
+		writeErr := make(chan error, 1)
+		h := TimeoutHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+			<-r.Context().Done()
+			_, err := w.Write([]byte("too late"))
+			writeErr <- err
+		}), 50*time.Millisecond, "too slow")
+
+		rw := new(geminitest.ResponseRecorder)
+		h.HandleGemini(rw, &Request{URL: u})
+
+		if rw.StatusCode != StatusTemporaryFailure {
+			t.Fatalf("wanted status code %d, got: %d", StatusTemporaryFailure, rw.StatusCode)
+		}
+		if rw.Meta != "too slow" {
+			t.Fatalf("wanted meta %q, got: %q", "too slow", rw.Meta)
+		}
+		if err := <-writeErr; !errors.Is(err, ErrHandlerTimeout) {
+			t.Fatalf("wanted ErrHandlerTimeout, got: %v", err)
+		}
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		h := TimeoutHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+			cancel()
+			<-r.Context().Done()
+		}), time.Second, "")
+
+		rw := new(geminitest.ResponseRecorder)
+		h.HandleGemini(rw, (&Request{URL: u}).WithContext(ctx))
+
+		if rw.StatusCode != 0 {
+			t.Fatalf("wanted no response for a client that went away, got: %d %s", rw.StatusCode, rw.Meta)
+		}
+	})
+
+	t.Run("panic after timeout", func(t *testing.T) {
+		pu, _ := url.Parse("gemini://timeout-panic.test/")
+		counter := panicCount.With(prometheus.Labels{"domain": "timeout-panic.test"})
+		before := counterValue(t, counter)
+
+		release := make(chan struct{})
+		h := TimeoutHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+			<-release
+			panic("late")
+		}), 10*time.Millisecond, "")
+
+		rw := new(geminitest.ResponseRecorder)
+		h.HandleGemini(rw, &Request{URL: pu})
+		if rw.StatusCode != StatusTemporaryFailure {
+			t.Fatalf("wanted status code %d, got: %d", StatusTemporaryFailure, rw.StatusCode)
+		}
+		close(release)
+
+		for i := 0; i < 100 && counterValue(t, counter) == before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if counterValue(t, counter) != before+1 {
+			t.Fatal("wanted the panic to be counted")
+		}
+	})
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(NotFound())
+	s.ReadTimeout = 50 * time.Millisecond
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	data, err := io.ReadAll(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "59 invalid request\r\n" {
+		t.Fatalf("wanted a bad request response, got: %q", data)
+	}
+}
@@ -6,3 +6,19 @@ func NotFound() Handler {
 		w.Status(StatusNotFound, r.URL.Path+" not found")
 	})
 }
+
+// RequireCert wraps a handler so that it is only called for requests that
+// come with a client certificate. Other requests are answered with
+// StatusClientCertificateRequired.
+//
+// The server's TLS configuration must ask clients for certificates (such as
+// with tls.RequestClientCert) for this to be useful.
+func RequireCert(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Cert == nil {
+			w.Status(StatusClientCertificateRequired, "client certificate required")
+			return
+		}
+		h.HandleGemini(w, r)
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"within.website/ln"
+)
+
+var upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "rhea_upstream_healthy",
+	Help: "Whether a reverse proxy upstream is taking requests (1) or not (0)",
+}, []string{"domain", "upstream"})
+
+// errNoHealthyUpstreams is returned when every upstream of a reverse proxy
+// is down.
+var errNoHealthyUpstreams = errors.New("no healthy upstreams")
+
+// Defaults for passive health checking.
+const (
+	defaultMaxFails = 3
+	defaultCooldown = 30 * time.Second
+)
+
+// HealthCheck makes a reverse proxy probe its upstreams periodically.
+// Upstreams that fail a probe don't get requests until they pass one.
+type HealthCheck struct {
+	// URL is requested from every upstream. It defaults to the root of
+	// the proxied domain.
+	URL string `json:"url"`
+
+	// Status is the status the upstreams must answer with. It defaults to
+	// 20.
+	Status int `json:"status"`
+
+	// Interval is how long to wait between probes. It defaults to 10
+	// seconds.
+	Interval Duration `json:"interval"`
+
+	// Timeout is how long a probe may take. It defaults to 5 seconds.
+	Timeout Duration `json:"timeout"`
+}
+
+// upstreamHealth is what a reverse proxy knows about the health of one of
+// its upstreams. It works as a circuit breaker: after too many failures in
+// a row the upstream is ejected for a cooldown, after which requests are
+// let through again. One more failure ejects it for another cooldown.
+type upstreamHealth struct {
+	domain, upstream string
+	maxFails         int
+	cooldown         time.Duration
+
+	mu           sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+	probeFailed  bool
+}
+
+func newUpstreamHealth(domain, upstream string, maxFails int, cooldown time.Duration) *upstreamHealth {
+	if maxFails <= 0 {
+		maxFails = defaultMaxFails
+	}
+	if cooldown <= 0 {
+		cooldown = defaultCooldown
+	}
+
+	uh := &upstreamHealth{
+		domain:   domain,
+		upstream: upstream,
+		maxFails: maxFails,
+		cooldown: cooldown,
+	}
+	uh.report(time.Now())
+	return uh
+}
+
+// available reports whether the upstream may get requests.
+func (uh *upstreamHealth) available(now time.Time) bool {
+	uh.mu.Lock()
+	defer uh.mu.Unlock()
+
+	return uh.availableLocked(now)
+}
+
+func (uh *upstreamHealth) availableLocked(now time.Time) bool {
+	return !uh.probeFailed && !now.Before(uh.ejectedUntil)
+}
+
+// success records a request or probe that worked.
+func (uh *upstreamHealth) success(now time.Time) {
+	uh.mu.Lock()
+	uh.fails = 0
+	uh.ejectedUntil = time.Time{}
+	uh.mu.Unlock()
+
+	uh.report(now)
+}
+
+// failure records a request that failed and ejects the upstream if it
+// failed too often in a row.
+func (uh *upstreamHealth) failure(now time.Time) {
+	uh.mu.Lock()
+	uh.fails++
+	if uh.fails >= uh.maxFails {
+		uh.ejectedUntil = now.Add(uh.cooldown)
+	}
+	uh.mu.Unlock()
+
+	uh.report(now)
+}
+
+// probed records the result of an active health check.
+func (uh *upstreamHealth) probed(ok bool, now time.Time) {
+	uh.mu.Lock()
+	uh.probeFailed = !ok
+	uh.mu.Unlock()
+
+	if ok {
+		uh.success(now)
+		return
+	}
+	uh.report(now)
+}
+
+// report updates the health gauge of the upstream.
+func (uh *upstreamHealth) report(now time.Time) {
+	value := 0.0
+	if uh.available(now) {
+		value = 1
+	}
+	upstreamHealthy.With(prometheus.Labels{"domain": uh.domain, "upstream": uh.upstream}).Set(value)
+}
+
+// checkHealth probes every upstream of rp until ctx is done.
+func (rp *ReverseProxy) checkHealth(ctx context.Context) {
+	interval := rp.HealthCheck.Interval.Duration()
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, up := range rp.upstreams {
+			up := up
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := rp.probe(ctx, up)
+				if err != nil && ctx.Err() == nil {
+					ln.Error(ctx, err, ln.Action("health check"), ln.F{"domain": rp.Domain, "upstream": up.URL})
+				}
+				if ctx.Err() == nil {
+					up.health.probed(err == nil, time.Now())
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probe makes a health check request to up.
+func (rp *ReverseProxy) probe(ctx context.Context, up *Upstream) error {
+	hc := rp.HealthCheck
+
+	u := hc.URL
+	if u == "" {
+		u = "gemini://" + rp.Domain + "/"
+	}
+	want := hc.Status
+	if want == 0 {
+		want = gemini.StatusSuccess
+	}
+	timeout := hc.Timeout.Duration()
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	req, err := gemini.NewRequestWithContext(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	client := &gemini.Client{
+		DialContext: func(ctx context.Context, _ string) (net.Conn, error) {
+			return rp.dialUpstream(ctx, up, nil)
+		},
+		CheckRedirect: func(*gemini.Request, []*gemini.Request) error {
+			return gemini.ErrUseLastResponse
+		},
+		Timeout: timeout,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.Status != want {
+		return fmt.Errorf("wanted status %d, got: %d %s", want, resp.Status, resp.Meta)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	uh := newUpstreamHealth("test.server", "tcp://backend", 2, time.Minute)
+	now := time.Now()
+
+	uh.failure(now)
+	if !uh.available(now) {
+		t.Fatal("wanted upstream to stay available after one failure")
+	}
+
+	uh.failure(now)
+	if uh.available(now) {
+		t.Fatal("wanted upstream to be ejected after two failures")
+	}
+	if !uh.available(now.Add(time.Minute)) {
+		t.Fatal("wanted upstream to be available again after the cooldown")
+	}
+
+	now = now.Add(time.Minute)
+	uh.failure(now)
+	if uh.available(now) {
+		t.Fatal("wanted a failure after the cooldown to eject the upstream again")
+	}
+
+	uh.success(now)
+	if !uh.available(now) {
+		t.Fatal("wanted a success to close the circuit")
+	}
+
+	uh.probed(false, now)
+	if uh.available(now) {
+		t.Fatal("wanted a failed probe to take the upstream out")
+	}
+	uh.probed(true, now)
+	if !uh.available(now) {
+		t.Fatal("wanted a passed probe to bring the upstream back")
+	}
+}
+
+// deadAddr returns an address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestReverseProxyFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := gemini.NewServer(testHandler{})
+	go s.Serve(l)
+	defer s.Close()
+
+	rp := ReverseProxy{
+		To:       []string{"tcp://" + deadAddr(t), "tcp://" + l.Addr().String()},
+		Domain:   "test.server",
+		MaxFails: 1,
+	}
+	if err := rp.load(); err != nil {
+		t.Fatal(err)
+	}
+	dead := rp.upstreams[0]
+
+	for i := 0; i < 10; i++ {
+		u, _ := url.Parse("gemini://foo.local")
+		rw := new(geminitest.ResponseRecorder)
+		rp.HandleGemini(rw, &gemini.Request{URL: u})
+
+		if rw.StatusCode != gemini.StatusSuccess {
+			t.Fatalf("wanted status code %d, got: %d %s", gemini.StatusSuccess, rw.StatusCode, rw.Meta)
+		}
+	}
+
+	if dead.health.available(time.Now()) {
+		t.Fatal("wanted the dead upstream to be ejected")
+	}
+}
+
+func TestReverseProxyClientGone(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := gemini.NewServer(gemini.HandlerFunc(func(w gemini.ResponseWriter, r *gemini.Request) {
+		<-release
+		w.Status(gemini.StatusSuccess, "text/plain")
+	}))
+	go s.Serve(l)
+	defer s.Close()
+
+	rp := ReverseProxy{
+		To:       []string{"tcp://" + l.Addr().String()},
+		Domain:   "test.server",
+		MaxFails: 1,
+	}
+	if err := rp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client goes away while waiting for the response, and before
+	// the upstream is even dialed.
+	for _, wait := range []time.Duration{50 * time.Millisecond, 0} {
+		ctx, cancel := context.WithCancel(context.Background())
+		if wait > 0 {
+			time.AfterFunc(wait, cancel)
+		} else {
+			cancel()
+		}
+
+		u, _ := url.Parse("gemini://foo.local")
+		rw := new(geminitest.ResponseRecorder)
+		rp.HandleGemini(rw, (&gemini.Request{URL: u}).WithContext(ctx))
+		cancel()
+
+		if !rp.upstreams[0].health.available(time.Now()) {
+			t.Fatal("wanted the upstream to stay available when the client goes away")
+		}
+	}
+}
+
+func TestReverseProxyNoHealthyUpstreams(t *testing.T) {
+	rp := ReverseProxy{
+		To:     []string{"tcp://" + deadAddr(t)},
+		Domain: "test.server",
+	}
+	if err := rp.load(); err != nil {
+		t.Fatal(err)
+	}
+	rp.upstreams[0].health.probed(false, time.Now())
+
+	u, _ := url.Parse("gemini://foo.local")
+	rw := new(geminitest.ResponseRecorder)
+	rp.HandleGemini(rw, &gemini.Request{URL: u})
+
+	if rw.StatusCode != gemini.StatusProxyError || rw.Meta != errNoHealthyUpstreams.Error() {
+		t.Fatalf("wanted status code %d, got: %d %s", gemini.StatusProxyError, rw.StatusCode, rw.Meta)
+	}
+}
+
+func TestReverseProxyProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := gemini.NewServer(gemini.HandlerFunc(func(w gemini.ResponseWriter, r *gemini.Request) {
+		if r.URL.Path == "/health" {
+			w.Status(gemini.StatusSuccess, "text/plain")
+			return
+		}
+		w.Status(gemini.StatusNotFound, "not found")
+	}))
+	go s.Serve(l)
+	defer s.Close()
+
+	for _, tt := range []struct {
+		url  string
+		want bool
+	}{
+		{"gemini://test.server/health", true},
+		{"gemini://test.server/", false},
+	} {
+		rp := ReverseProxy{
+			To:          []string{"tcp://" + l.Addr().String(), "tcp://" + deadAddr(t)},
+			Domain:      "test.server",
+			HealthCheck: &HealthCheck{URL: tt.url, Interval: Duration(time.Hour)},
+		}
+		if err := rp.load(); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			rp.checkHealth(ctx)
+			close(done)
+		}()
+
+		probed := func() bool {
+			now := time.Now()
+			return !rp.upstreams[1].health.available(now) && rp.upstreams[0].health.available(now) == tt.want
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !probed() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		<-done
+
+		if rp.upstreams[1].health.available(time.Now()) {
+			t.Fatalf("%s: wanted the dead upstream to fail its probe", tt.url)
+		}
+		if got := rp.upstreams[0].health.available(time.Now()); got != tt.want {
+			t.Fatalf("%s: wanted upstream availability %v, got: %v", tt.url, tt.want, got)
+		}
+	}
+}
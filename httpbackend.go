@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+)
+
+// Headers that tell an HTTP backend about the gemini request.
+const (
+	// headerGeminiInput carries the query of the request, which is what the
+	// user typed in after a 1x response. It stays percent-encoded, since
+	// input may span several lines and a header can't.
+	headerGeminiInput = "X-Gemini-Input"
+
+	// headerGeminiFingerprint carries the SHA-256 fingerprint of the client
+	// certificate, if there is one.
+	headerGeminiFingerprint = "X-Gemini-Client-Cert-Fingerprint"
+
+	// headerGeminiStatus and headerGeminiMeta let the backend answer with a
+	// gemini status that HTTP has no equivalent for, such as 10 INPUT.
+	headerGeminiStatus = "X-Gemini-Status"
+	headerGeminiMeta   = "X-Gemini-Meta"
+)
+
+// defaultHTTPBackendTimeout is how long an HTTP backend may take to start
+// answering when Timeout is not set.
+const defaultHTTPBackendTimeout = 30 * time.Second
+
+// HTTPBackend serves a site from an HTTP server, so that apps that only
+// speak HTTP can be put on Geminispace. Gemini requests become GET requests
+// and HTTP responses are turned into the closest gemini response.
+type HTTPBackend struct {
+	// URL is where the backend listens, such as "http://127.0.0.1:8080" or
+	// "unix:///run/app.sock". A path in an http:// URL is put in front of
+	// the paths of requests.
+	URL string `json:"url"`
+
+	// Timeout is how long the backend may take to start answering. It
+	// defaults to 30 seconds.
+	Timeout Duration `json:"timeout"`
+
+	base   *url.URL
+	client *http.Client
+}
+
+func (hb *HTTPBackend) load() error {
+	u, err := url.Parse(hb.URL)
+	if err != nil {
+		return err
+	}
+
+	timeout := hb.Timeout.Duration()
+	if timeout <= 0 {
+		timeout = defaultHTTPBackendTimeout
+	}
+	transport := &http.Transport{
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		hb.base = u
+	case "unix":
+		sock := filepath.Join("/", u.Host, u.Path)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		}
+		hb.base = &url.URL{Scheme: "http", Host: "localhost"}
+	default:
+		return fmt.Errorf("unknown scheme %q", u.Scheme)
+	}
+
+	hb.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+func (hb *HTTPBackend) HandleGemini(w gemini.ResponseWriter, r *gemini.Request) {
+	// Cleaning the path keeps ".." from leaving the path of the backend.
+	p := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+		p += "/"
+	}
+
+	u := *hb.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		w.Status(gemini.StatusBadRequest, "invalid request")
+		return
+	}
+
+	req.Host = r.URL.Hostname()
+	req.Header.Set("X-Forwarded-Proto", "gemini")
+	req.Header.Set("X-Forwarded-Host", r.URL.Host)
+	if !r.RemoteAddr.IsZero() {
+		req.Header.Set("X-Forwarded-For", r.RemoteAddr.IP().String())
+	}
+	if r.URL.RawQuery != "" {
+		if _, err := url.QueryUnescape(r.URL.RawQuery); err != nil {
+			w.Status(gemini.StatusBadRequest, "invalid input")
+			return
+		}
+		req.Header.Set(headerGeminiInput, r.URL.RawQuery)
+	}
+	if fp := r.Fingerprint(); fp != "" {
+		req.Header.Set(headerGeminiFingerprint, fp)
+	}
+
+	resp, err := hb.client.Do(req)
+	if err != nil {
+		w.Status(gemini.StatusProxyError, "backend is unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	status, meta := hb.translate(resp, r)
+	if len(meta) > gemini.DefaultMaxMetaLength {
+		w.Status(gemini.StatusProxyError, "backend response doesn't fit in a gemini header")
+		return
+	}
+
+	w.Status(status, meta)
+	if status/10 == gemini.StatusSuccess/10 {
+		copyBody(w, resp.Body)
+	}
+}
+
+// translate picks the gemini status and meta closest to an HTTP response.
+func (hb *HTTPBackend) translate(resp *http.Response, r *gemini.Request) (int, string) {
+	if s := resp.Header.Get(headerGeminiStatus); s != "" {
+		status, err := strconv.Atoi(s)
+		if err != nil || status < 10 || status > 69 {
+			return gemini.StatusProxyError, "backend sent an invalid gemini status"
+		}
+		return status, resp.Header.Get(headerGeminiMeta)
+	}
+
+	code := resp.StatusCode
+	switch {
+	case code >= 200 && code < 300:
+		meta := resp.Header.Get("Content-Type")
+		if meta == "" {
+			meta = "application/octet-stream"
+		}
+		return gemini.StatusSuccess, meta
+
+	case code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect:
+		return gemini.StatusRedirectPermanent, hb.location(resp, r)
+	case code >= 300 && code < 400 && resp.Header.Get("Location") != "":
+		return gemini.StatusRedirectTemporary, hb.location(resp, r)
+
+	case code == http.StatusBadRequest:
+		return gemini.StatusBadRequest, http.StatusText(code)
+	case code == http.StatusUnauthorized:
+		return gemini.StatusClientCertificateRequired, http.StatusText(code)
+	case code == http.StatusForbidden:
+		return gemini.StatusCertificateNotAuthorised, http.StatusText(code)
+	case code == http.StatusNotFound:
+		return gemini.StatusNotFound, http.StatusText(code)
+	case code == http.StatusGone:
+		return gemini.StatusGone, http.StatusText(code)
+	case code == http.StatusTooManyRequests:
+		return gemini.StatusSlowDown, retryAfter(resp.Header.Get("Retry-After"))
+	case code >= 400 && code < 500:
+		return gemini.StatusPermanentFailure, http.StatusText(code)
+
+	case code == http.StatusServiceUnavailable:
+		return gemini.StatusUnavailable, http.StatusText(code)
+	case code == http.StatusBadGateway || code == http.StatusGatewayTimeout:
+		return gemini.StatusProxyError, http.StatusText(code)
+	case code >= 500 && code < 600:
+		return gemini.StatusCGIError, http.StatusText(code)
+	}
+
+	return gemini.StatusProxyError, fmt.Sprintf("backend answered with status %d", code)
+}
+
+// location returns where a redirect points to. Redirects to the backend
+// itself are pointed at the gemini site instead.
+func (hb *HTTPBackend) location(resp *http.Response, r *gemini.Request) string {
+	loc := resp.Header.Get("Location")
+	target, err := resp.Request.URL.Parse(loc)
+	if err != nil {
+		return loc
+	}
+
+	if target.Host != resp.Request.URL.Host && target.Host != r.URL.Hostname() {
+		return target.String()
+	}
+
+	path := strings.TrimPrefix(target.EscapedPath(), strings.TrimSuffix(hb.base.EscapedPath(), "/"))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	result := "gemini://" + r.URL.Host + path
+	if target.RawQuery != "" {
+		result += "?" + target.RawQuery
+	}
+	return result
+}
+
+// retryAfter turns a Retry-After header into the number of seconds a 44
+// response asks clients to wait.
+func retryAfter(value string) string {
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return strconv.Itoa(secs)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if secs := int(time.Until(t).Round(time.Second).Seconds()); secs > 0 {
+			return strconv.Itoa(secs)
+		}
+	}
+	return "1"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/geminitest"
+	"inet.af/netaddr"
+)
+
+func TestHTTPBackend(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/gemini")
+		fmt.Fprintf(w, "%s %s %s %s %s", r.Host, r.Header.Get(headerGeminiInput), r.Header.Get(headerGeminiFingerprint), r.Header.Get("X-Forwarded-For"), r.URL.RawQuery)
+	})
+	mux.HandleFunc("/app/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/app/hello?x=1", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/app/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.org/", http.StatusFound)
+	})
+	mux.HandleFunc("/app/search", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerGeminiStatus, "10")
+		w.Header().Set(headerGeminiMeta, "What are you looking for?")
+	})
+	mux.HandleFunc("/app/private", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	mux.HandleFunc("/app/busy", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	mux.HandleFunc("/app/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/secret", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "outside of the app")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	hb := &HTTPBackend{URL: srv.URL + "/app/"}
+	if err := hb.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert := newTestClientCert(t)
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		meta   string
+		body   string
+	}{
+		{
+			path:   "/hello?what%20now",
+			status: gemini.StatusSuccess,
+			meta:   "text/gemini",
+			body:   "example.com what%20now " + gemini.Fingerprint(cert) + " 192.0.2.1 what%20now",
+		},
+		{
+			path:   "/hello?two%0D%0Alines",
+			status: gemini.StatusSuccess,
+			meta:   "text/gemini",
+			body:   "example.com two%0D%0Alines " + gemini.Fingerprint(cert) + " 192.0.2.1 two%0D%0Alines",
+		},
+		{path: "/moved", status: gemini.StatusRedirectPermanent, meta: "gemini://example.com/hello?x=1"},
+		{path: "/away", status: gemini.StatusRedirectTemporary, meta: "https://example.org/"},
+		{path: "/search", status: gemini.StatusInput, meta: "What are you looking for?"},
+		{path: "/private", status: gemini.StatusClientCertificateRequired, meta: "Unauthorized"},
+		{path: "/busy", status: gemini.StatusSlowDown, meta: "30"},
+		{path: "/broken", status: gemini.StatusCGIError, meta: "Internal Server Error"},
+		{path: "/nope", status: gemini.StatusNotFound, meta: "Not Found"},
+		{path: "/../secret", status: gemini.StatusNotFound, meta: "Not Found"},
+		{path: "/%2e%2e/secret", status: gemini.StatusNotFound, meta: "Not Found"},
+		{path: "/x/../search", status: gemini.StatusInput, meta: "What are you looking for?"},
+	} {
+		u, _ := url.Parse("gemini://example.com" + tt.path)
+		rw := new(geminitest.ResponseRecorder)
+		hb.HandleGemini(rw, &gemini.Request{
+			URL:        u,
+			Cert:       cert,
+			RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:56324"),
+		})
+
+		if rw.StatusCode != tt.status || rw.Meta != tt.meta {
+			t.Fatalf("%s: wanted %d %q, got: %d %q", tt.path, tt.status, tt.meta, rw.StatusCode, rw.Meta)
+		}
+		if tt.body != "" && rw.Body.String() != tt.body {
+			t.Fatalf("%s: wanted body %q, got: %q", tt.path, tt.body, rw.Body.String())
+		}
+	}
+}
+
+func TestHTTPBackendUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, r.URL.Path)
+		})},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	hb := &HTTPBackend{URL: "unix://" + sock}
+	if err := hb.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("gemini://example.com/foo")
+	rw := new(geminitest.ResponseRecorder)
+	hb.HandleGemini(rw, &gemini.Request{URL: u})
+
+	if rw.StatusCode != gemini.StatusSuccess || rw.Meta != "text/plain" || rw.Body.String() != "/foo" {
+		t.Fatalf("wanted the backend's response, got: %d %s", rw.StatusCode, rw.Meta)
+	}
+}
+
+func TestHTTPBackendUnavailable(t *testing.T) {
+	hb := &HTTPBackend{URL: "http://" + deadAddr(t)}
+	if err := hb.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("gemini://example.com/")
+	rw := new(geminitest.ResponseRecorder)
+	hb.HandleGemini(rw, &gemini.Request{URL: u})
+
+	if rw.StatusCode != gemini.StatusProxyError {
+		t.Fatalf("wanted status code %d, got: %d %s", gemini.StatusProxyError, rw.StatusCode, rw.Meta)
+	}
+}
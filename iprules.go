@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Xe/rhea/gemini"
+	"inet.af/netaddr"
+)
+
+// IPRules are lists of addresses or CIDR ranges that are allowed or denied
+// access. Denied addresses always lose. If Allow is empty, every address
+// that isn't denied is allowed.
+type IPRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	filter *gemini.IPFilter
+}
+
+// load parses the address lists of the rules.
+func (ir *IPRules) load() error {
+	f := &gemini.IPFilter{}
+	var err error
+
+	if len(ir.Allow) != 0 {
+		f.Allow, err = parseIPSet(ir.Allow)
+		if err != nil {
+			return fmt.Errorf("allow: %v", err)
+		}
+	}
+
+	if len(ir.Deny) != 0 {
+		f.Deny, err = parseIPSet(ir.Deny)
+		if err != nil {
+			return fmt.Errorf("deny: %v", err)
+		}
+	}
+
+	ir.filter = f
+	return nil
+}
+
+// parseIPSet builds an IPSet out of addresses and CIDR ranges such as
+// "192.0.2.1" or "2001:db8::/32".
+func parseIPSet(entries []string) (*netaddr.IPSet, error) {
+	var b netaddr.IPSetBuilder
+
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			p, err := netaddr.ParseIPPrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			b.AddPrefix(p.Masked())
+			continue
+		}
+
+		ip, err := netaddr.ParseIP(entry)
+		if err != nil {
+			return nil, err
+		}
+		b.Add(ip)
+	}
+
+	return b.IPSet()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/url"
+	"strings"
+
+	"github.com/Xe/rhea/gemini"
+)
+
+// maxLinkLineLength is the length of the longest line that is checked for a
+// link. Longer lines are passed through as they are, so that a body without
+// newlines doesn't end up buffered whole.
+const maxLinkLineLength = 4096
+
+// linkRewriter turns links to the upstream domain of a reverse proxy into
+// links to the domain the client asked for, in redirects and in text/gemini
+// bodies. Bodies are rewritten a line at a time as they stream through, so
+// the caller must call flush once the response is done to write out a last
+// line without a newline.
+type linkRewriter struct {
+	gemini.ResponseWriter
+	from, to string
+
+	gemtext bool   // the body is text/gemini
+	pre     bool   // in a preformatted block
+	long    bool   // the current line is too long and passed through
+	line    []byte // the current line so far
+}
+
+func newLinkRewriter(w gemini.ResponseWriter, from, to string) *linkRewriter {
+	return &linkRewriter{ResponseWriter: w, from: from, to: to}
+}
+
+func (lr *linkRewriter) Status(status int, meta string) {
+	switch status / 10 {
+	case gemini.StatusRedirect / 10:
+		meta = lr.rewriteURL(meta)
+	case gemini.StatusSuccess / 10:
+		mt, _, err := mime.ParseMediaType(meta)
+		lr.gemtext = err == nil && mt == "text/gemini"
+	}
+	lr.ResponseWriter.Status(status, meta)
+}
+
+func (lr *linkRewriter) Write(p []byte) (int, error) {
+	if !lr.gemtext {
+		return lr.ResponseWriter.Write(p)
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if lr.long {
+				return n, lr.write(p)
+			}
+			lr.line = append(lr.line, p...)
+			if len(lr.line) > maxLinkLineLength {
+				lr.long = true
+				lr.togglePre(lr.line)
+				err := lr.write(lr.line)
+				lr.line = lr.line[:0]
+				return n, err
+			}
+			return n, nil
+		}
+
+		chunk := p[:i+1]
+		p = p[i+1:]
+		if lr.long {
+			lr.long = false
+			if err := lr.write(chunk); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		lr.line = append(lr.line, chunk...)
+		if err := lr.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// flush writes out the current line.
+func (lr *linkRewriter) flush() error {
+	if len(lr.line) == 0 {
+		return nil
+	}
+	err := lr.write(lr.rewriteLine(lr.line))
+	lr.line = lr.line[:0]
+	return err
+}
+
+func (lr *linkRewriter) write(p []byte) error {
+	_, err := lr.ResponseWriter.Write(p)
+	return err
+}
+
+// togglePre keeps track of preformatted blocks, whose lines are never
+// links.
+func (lr *linkRewriter) togglePre(line []byte) bool {
+	if bytes.HasPrefix(line, []byte("```")) {
+		lr.pre = !lr.pre
+		return true
+	}
+	return false
+}
+
+// rewriteLine rewrites the URL of a link line.
+func (lr *linkRewriter) rewriteLine(line []byte) []byte {
+	if lr.togglePre(line) || lr.pre || !bytes.HasPrefix(line, []byte("=>")) {
+		return line
+	}
+
+	start := len(line) - len(bytes.TrimLeft(line[2:], " \t"))
+	end := bytes.IndexAny(line[start:], " \t\r\n")
+	if end < 0 {
+		end = len(line)
+	} else {
+		end += start
+	}
+
+	link := string(line[start:end])
+	rewritten := lr.rewriteURL(link)
+	if rewritten == link {
+		return line
+	}
+
+	result := make([]byte, 0, len(line)-len(link)+len(rewritten))
+	result = append(result, line[:start]...)
+	result = append(result, rewritten...)
+	return append(result, line[end:]...)
+}
+
+// rewriteURL points a gemini URL on the upstream domain to the public one.
+// Anything else, including relative URLs, is left alone.
+func (lr *linkRewriter) rewriteURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "gemini" && u.Scheme != "") || !sameHost(u.Host, lr.from) {
+		return raw
+	}
+
+	// Only the host is swapped, so that the rest of the URL stays exactly
+	// as the upstream wrote it.
+	i := strings.Index(raw, "//") + 2
+	if !strings.HasPrefix(raw[i:], u.Host) {
+		return raw
+	}
+	return raw[:i] + lr.to + raw[i+len(u.Host):]
+}
+
+// sameHost reports whether two hosts, with or without the default port,
+// are the same.
+func sameHost(a, b string) bool {
+	port := ":" + gemini.DefaultPort
+	return a != "" && strings.EqualFold(strings.TrimSuffix(a, port), strings.TrimSuffix(b, port))
+}
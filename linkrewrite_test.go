@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/geminitest"
+)
+
+func TestLinkRewriter(t *testing.T) {
+	long := "=> gemini://backend.local/" + strings.Repeat("a", maxLinkLineLength) + "\n"
+
+	for _, tt := range []struct {
+		name, meta, body, want string
+	}{
+		{
+			name: "links",
+			meta: "text/gemini",
+			body: "# Hi\n=> gemini://backend.local/foo Foo\n=>\tgemini://BACKEND.local:1965/bar?q=1\n=> //backend.local/baz\n=> /relative\n=> gemini://elsewhere.local/ Elsewhere\n=> https://backend.local/ Web\n",
+			want: "# Hi\n=> gemini://example.com/foo Foo\n=>\tgemini://example.com/bar?q=1\n=> //example.com/baz\n=> /relative\n=> gemini://elsewhere.local/ Elsewhere\n=> https://backend.local/ Web\n",
+		},
+		{
+			name: "crlf and no trailing newline",
+			meta: "text/gemini; charset=utf-8",
+			body: "=> gemini://backend.local/\r\n=> gemini://backend.local/last",
+			want: "=> gemini://example.com/\r\n=> gemini://example.com/last",
+		},
+		{
+			name: "preformatted",
+			meta: "text/gemini",
+			body: "```\n=> gemini://backend.local/\n```\n=> gemini://backend.local/\n",
+			want: "```\n=> gemini://backend.local/\n```\n=> gemini://example.com/\n",
+		},
+		{
+			name: "long line",
+			meta: "text/gemini",
+			body: long + "=> gemini://backend.local/\n",
+			want: long + "=> gemini://example.com/\n",
+		},
+		{
+			name: "not gemtext",
+			meta: "text/plain",
+			body: "=> gemini://backend.local/\n",
+			want: "=> gemini://backend.local/\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := new(geminitest.ResponseRecorder)
+			lr := newLinkRewriter(rw, "backend.local", "example.com")
+			lr.Status(gemini.StatusSuccess, tt.meta)
+
+			// Writing a byte at a time splits every line across writes.
+			for i := 0; i < len(tt.body); i++ {
+				if _, err := io.WriteString(lr, tt.body[i:i+1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := lr.flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := rw.Body.String(); got != tt.want {
+				t.Fatalf("wanted body %q, got: %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLinkRewriterRedirect(t *testing.T) {
+	for meta, want := range map[string]string{
+		"gemini://backend.local/moved": "gemini://example.com/moved",
+		"/moved":                       "/moved",
+		"gemini://elsewhere.local/":    "gemini://elsewhere.local/",
+	} {
+		rw := new(geminitest.ResponseRecorder)
+		newLinkRewriter(rw, "backend.local", "example.com").Status(gemini.StatusRedirect, meta)
+		if rw.Meta != want {
+			t.Fatalf("wanted meta %q, got: %q", want, rw.Meta)
+		}
+	}
+}
+
+func TestReverseProxyRewriteLinks(t *testing.T) {
+	addr := rawUpstream(t, func(conn net.Conn) {
+		io.WriteString(conn, "20 text/gemini\r\n=> gemini://backend.local/foo Foo\n")
+	})
+
+	rp := ReverseProxy{
+		Upstreams:    []Upstream{{URL: addr}},
+		Domain:       "backend.local",
+		RewriteLinks: true,
+	}
+	if err := rp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("gemini://example.com/")
+	rw := new(geminitest.ResponseRecorder)
+	rp.HandleGemini(rw, &gemini.Request{URL: u})
+
+	if want := "=> gemini://example.com/foo Foo\n"; rw.Body.String() != want {
+		t.Fatalf("wanted body %q, got: %q", want, rw.Body.String())
+	}
+}
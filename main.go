@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -10,7 +11,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/Xe/rhea/gemini"
 	"github.com/facebookgo/flagenv"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"within.website/ln"
@@ -29,7 +33,8 @@ func init() {
 }
 
 var (
-	configPath = flag.String("config", "./config.json", "config filename")
+	configPath      = flag.String("config", "./config.json", "config filename")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests when shutting down")
 )
 
 func main() {
@@ -56,8 +61,27 @@ func run(ctx context.Context) error {
 		return fmt.Errorf("can't read %s: %v", *configPath, err)
 	}
 
-	go httpServer(ctx, cfg)
-	go geminiServer(ctx, cfg)
+	rh, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.HTTPPort),
+		Handler: httpMux(rh),
+	}
+
+	go httpServer(ctx, hs)
+	go geminiServer(ctx, rh)
+
+	var gws *http.Server
+	if cfg.WebGateway != nil && cfg.WebGateway.TLSPort != 0 {
+		gws = &http.Server{
+			Addr:      fmt.Sprintf(":%d", cfg.WebGateway.TLSPort),
+			Handler:   rh.webGateway(http.NotFoundHandler()),
+			TLSConfig: rh.gatewayTLSConfig(),
+		}
+		go httpsServer(ctx, gws)
+	}
 
 	for _, site := range cfg.Sites {
 		ln.Log(ctx, ln.Info("loaded site %s", site.Domain))
@@ -65,27 +89,65 @@ func run(ctx context.Context) error {
 	ln.Log(ctx, ln.Info("listening on gemini=%d http=%d", cfg.Port, cfg.HTTPPort))
 
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt)
-	<-sigchan
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-sigchan; sig == syscall.SIGHUP; sig = <-sigchan {
+		ln.Log(ctx, ln.Info("reloading"))
+		if err := rh.Reload(); err != nil {
+			ln.Error(ctx, err, ln.Action("reloading"))
+		}
+	}
 	fmt.Print("\r")
 	ln.Log(ctx, ln.Info("shutting down"))
 
+	sctx, cancel := context.WithTimeout(ctx, *shutdownTimeout)
+	defer cancel()
+
+	if err := rh.Shutdown(sctx); err != nil {
+		return fmt.Errorf("can't shut down gemini server: %v", err)
+	}
+	if err := hs.Shutdown(sctx); err != nil {
+		return fmt.Errorf("can't shut down http server: %v", err)
+	}
+	if gws != nil {
+		if err := gws.Shutdown(sctx); err != nil {
+			return fmt.Errorf("can't shut down https server: %v", err)
+		}
+	}
+
 	return nil
 }
 
-func httpServer(ctx context.Context, cfg Config) {
+func httpMux(rh *Rhea) http.Handler {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.HTTPPort), mux)
-	if err != nil {
+	if rh.cfg.AdminToken != "" {
+		mux.Handle("/admin/bans", rh.adminOnly(rh.handleBans))
+		mux.Handle("/admin/cache/purge", rh.adminOnly(rh.handleCachePurge))
+	}
+
+	if rh.cfg.WebGateway != nil {
+		return rh.webGateway(mux)
+	}
+	return mux
+}
+
+func httpServer(ctx context.Context, hs *http.Server) {
+	err := hs.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		ln.FatalErr(ctx, err)
 	}
 }
 
-func geminiServer(ctx context.Context, cfg Config) {
-	rh := New(cfg)
+func httpsServer(ctx context.Context, hs *http.Server) {
+	err := hs.ListenAndServeTLS("", "")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		ln.FatalErr(ctx, err)
+	}
+}
+
+func geminiServer(ctx context.Context, rh *Rhea) {
 	err := rh.ListenAndServe()
-	if err != nil {
+	if err != nil && !errors.Is(err, gemini.ErrServerClosed) {
 		ln.FatalErr(ctx, err)
 	}
 }
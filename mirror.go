@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"within.website/ln"
+)
+
+var (
+	mirrorRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rhea_mirror_requests_total",
+		Help: "The number of requests mirrored, by how the mirror's response compared to the primary's",
+	}, []string{"domain", "outcome"})
+
+	mirrorDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rhea_mirror_duration_seconds",
+		Help:    "How long mirrored requests took on the primary and on the mirror",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"domain", "target"})
+)
+
+// Outcomes of a mirrored request.
+const (
+	mirrorMatch          = "match"
+	mirrorStatusMismatch = "status_mismatch"
+	mirrorSizeMismatch   = "size_mismatch"
+	mirrorError          = "error"
+	mirrorDropped        = "dropped"
+)
+
+// defaultMirrorMaxInFlight is how many mirrored requests may be in flight
+// at once when MaxInFlight is not set.
+const defaultMirrorMaxInFlight = 64
+
+// Mirror sends copies of some of the requests of a reverse proxy to
+// another upstream, such as a new version of an app being tested. The
+// responses of the mirror are thrown away after they are compared to the
+// responses the clients got.
+type Mirror struct {
+	Upstream
+
+	// Percent is the percentage of requests that are mirrored.
+	Percent float64 `json:"percent"`
+
+	// Timeout is how long a mirrored request may take. It defaults to 30
+	// seconds.
+	Timeout Duration `json:"timeout"`
+
+	// MaxInFlight limits how many mirrored requests are in flight at once.
+	// Requests over the limit are not mirrored. It defaults to 64.
+	MaxInFlight int `json:"max_in_flight"`
+
+	sem chan struct{}
+}
+
+func (m *Mirror) load() error {
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if err := m.Upstream.load(); err != nil {
+		return err
+	}
+
+	max := m.MaxInFlight
+	if max <= 0 {
+		max = defaultMirrorMaxInFlight
+	}
+	m.sem = make(chan struct{}, max)
+
+	return nil
+}
+
+// sample decides whether a request is mirrored.
+func (m *Mirror) sample() bool {
+	return rand.Float64()*100 < m.Percent
+}
+
+// mirrorResult is what came back from one side of a mirrored request.
+type mirrorResult struct {
+	status   int
+	bytes    int64
+	duration time.Duration
+	err      error
+}
+
+// mirror sends a copy of r to the mirror of rp. It returns a channel the
+// result of the primary request must be sent on once it is known.
+func (rp ReverseProxy) mirror(r *gemini.Request) chan<- mirrorResult {
+	m := rp.Mirror
+
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		mirrorRequests.With(prometheus.Labels{"domain": rp.Domain, "outcome": mirrorDropped}).Inc()
+		return nil
+	}
+
+	timeout := m.Timeout.Duration()
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	// The mirrored request must outlive the client's, so it gets a context
+	// and URL of its own.
+	u := *r.URL
+	u.Host = rp.Domain
+	mr := r.WithContext(context.Background())
+	mr.URL = &u
+
+	primary := make(chan mirrorResult, 1)
+	go func() {
+		defer func() { <-m.sem }()
+
+		client := &gemini.Client{
+			DialContext: func(ctx context.Context, _ string) (net.Conn, error) {
+				return rp.dialUpstream(ctx, &m.Upstream, mr)
+			},
+			CheckRedirect: func(*gemini.Request, []*gemini.Request) error {
+				return gemini.ErrUseLastResponse
+			},
+			Timeout: timeout,
+		}
+
+		var mirrored mirrorResult
+		start := time.Now()
+		resp, err := client.Do(mr)
+		if err == nil {
+			mirrored.status = resp.Status
+			mirrored.bytes, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		mirrored.duration = time.Since(start)
+		mirrored.err = err
+
+		var orig mirrorResult
+		select {
+		case orig = <-primary:
+		case <-time.After(timeout):
+			mirrorRequests.With(prometheus.Labels{"domain": rp.Domain, "outcome": mirrorError}).Inc()
+			return
+		}
+
+		mirrorDuration.With(prometheus.Labels{"domain": rp.Domain, "target": "primary"}).Observe(orig.duration.Seconds())
+		mirrorDuration.With(prometheus.Labels{"domain": rp.Domain, "target": "mirror"}).Observe(mirrored.duration.Seconds())
+
+		outcome := mirrorMatch
+		switch {
+		case mirrored.err != nil:
+			outcome = mirrorError
+		case mirrored.status != orig.status:
+			outcome = mirrorStatusMismatch
+		case mirrored.bytes != orig.bytes:
+			outcome = mirrorSizeMismatch
+		}
+		mirrorRequests.With(prometheus.Labels{"domain": rp.Domain, "outcome": outcome}).Inc()
+
+		if outcome != mirrorMatch {
+			f := ln.F{
+				"domain":           rp.Domain,
+				"path":             u.Path,
+				"mirror":           m.URL,
+				"outcome":          outcome,
+				"primary_status":   orig.status,
+				"mirror_status":    mirrored.status,
+				"primary_bytes":    orig.bytes,
+				"mirror_bytes":     mirrored.bytes,
+				"primary_duration": orig.duration,
+				"mirror_duration":  mirrored.duration,
+			}
+			if mirrored.err != nil {
+				f["mirror_err"] = mirrored.err.Error()
+			}
+			ln.Log(context.Background(), ln.Info("mirrored response differs"), f)
+		}
+	}()
+
+	return primary
+}
+
+// recordingWriter remembers the status and size of a response.
+type recordingWriter struct {
+	gemini.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rw *recordingWriter) Status(status int, meta string) {
+	rw.status = status
+	rw.ResponseWriter.Status(status, meta)
+}
+
+func (rw *recordingWriter) Write(data []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(data)
+	rw.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Xe/rhea/gemini"
+	"github.com/Xe/rhea/gemini/geminitest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestReverseProxyMirror(t *testing.T) {
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := gemini.NewServer(testHandler{})
+	go ps.Serve(primary)
+	defer ps.Close()
+
+	mirrored := make(chan string, 10)
+	mirror, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := gemini.NewServer(gemini.HandlerFunc(func(w gemini.ResponseWriter, r *gemini.Request) {
+		mirrored <- r.URL.String()
+		w.Status(gemini.StatusNotFound, "not found")
+	}))
+	go ms.Serve(mirror)
+	defer ms.Close()
+
+	rp := ReverseProxy{
+		To:     []string{"tcp://" + primary.Addr().String()},
+		Domain: "test.server",
+		Mirror: &Mirror{
+			Upstream: Upstream{URL: "tcp://" + mirror.Addr().String()},
+			Percent:  100,
+		},
+	}
+	if err := rp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches := mirrorRequests.With(prometheus.Labels{"domain": "test.server", "outcome": mirrorStatusMismatch})
+	before := counterValue(t, mismatches)
+
+	u, _ := url.Parse("gemini://foo.local/path?q")
+	rw := new(geminitest.ResponseRecorder)
+	rp.HandleGemini(rw, &gemini.Request{URL: u})
+
+	if rw.StatusCode != gemini.StatusSuccess {
+		t.Fatalf("wanted the client to get the primary's status %d, got: %d", gemini.StatusSuccess, rw.StatusCode)
+	}
+
+	select {
+	case got := <-mirrored:
+		if got != "gemini://test.server/path?q" {
+			t.Fatalf("wanted the mirror to get the proxied URL, got: %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mirror didn't get the request")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(t, mismatches) == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := counterValue(t, mismatches); got != before+1 {
+		t.Fatalf("wanted the status mismatch to be counted, got: %v", got-before)
+	}
+}
+
+func TestMirrorLoad(t *testing.T) {
+	for _, m := range []Mirror{
+		{Upstream: Upstream{URL: "tcp://127.0.0.1:1965"}, Percent: 101},
+		{Upstream: Upstream{URL: "ftp://127.0.0.1:1965"}, Percent: 10},
+	} {
+		if err := m.load(); err == nil {
+			t.Fatalf("wanted an error loading %+v", m)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Xe/rhea/gemini"
+)
+
+// ProxyProtocol makes rhea read PROXY protocol headers sent by a load
+// balancer in front of it, so that clients are seen with their real
+// addresses.
+type ProxyProtocol struct {
+	// Trusted is the list of addresses or CIDR ranges of the load
+	// balancers. Only they may send PROXY protocol headers.
+	Trusted []string `json:"trusted"`
+
+	// TrustAll trusts every address instead, which is only safe when rhea
+	// can't be reached without going through the load balancer. Anyone
+	// else could pick the address and client certificate they are seen
+	// with.
+	TrustAll bool `json:"trust_all"`
+
+	// HeaderTimeout is how long a load balancer has to send the header.
+	HeaderTimeout Duration `json:"header_timeout"`
+
+	pp *gemini.ProxyProtocol
+}
+
+// load parses the trusted addresses.
+func (p *ProxyProtocol) load() error {
+	pp := &gemini.ProxyProtocol{
+		TrustAll:      p.TrustAll,
+		HeaderTimeout: p.HeaderTimeout.Duration(),
+	}
+
+	if len(p.Trusted) == 0 && !p.TrustAll {
+		return fmt.Errorf("no trusted addresses, list the load balancers in trusted or set trust_all")
+	}
+	if len(p.Trusted) != 0 {
+		set, err := parseIPSet(p.Trusted)
+		if err != nil {
+			return fmt.Errorf("trusted: %v", err)
+		}
+		pp.Trusted = set
+	}
+
+	p.pp = pp
+	return nil
+}
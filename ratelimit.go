@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Xe/rhea/gemini"
+)
+
+// RateLimit configures how fast clients may make requests. Clients going
+// faster are answered with 44 SLOW DOWN.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+
+	// IPv6Prefix is the prefix length IPv6 clients are grouped by. It
+	// defaults to 64.
+	IPv6Prefix uint8 `json:"ipv6_prefix"`
+
+	// ByCertificate also tracks clients that present a certificate by its
+	// fingerprint, so they are limited across all of their addresses.
+	// Their address is limited all the same.
+	ByCertificate bool `json:"by_certificate"`
+
+	// MaxClients bounds how many clients are remembered at once.
+	MaxClients int `json:"max_clients"`
+
+	limiter *gemini.RateLimiter
+}
+
+func (rl *RateLimit) load() error {
+	if rl.RequestsPerSecond <= 0 {
+		return fmt.Errorf("requests_per_second must be positive")
+	}
+	if rl.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6_prefix must be at most 128")
+	}
+
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	rl.limiter = gemini.NewRateLimiter(rl.RequestsPerSecond, burst)
+	rl.limiter.IPv6Prefix = rl.IPv6Prefix
+	rl.limiter.ByCertificate = rl.ByCertificate
+	rl.limiter.MaxClients = rl.MaxClients
+	return nil
+}
@@ -1,66 +1,575 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"net/url"
+	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Xe/rhea/gemini"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"within.website/ln"
+)
+
+var upstreamTruncated = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rhea_upstream_truncated_responses_total",
+	Help: "The number of upstream responses whose body failed partway through",
+}, []string{"domain", "upstream"})
+
+// Defaults for upstream timeouts.
+const (
+	defaultConnectTimeout   = 10 * time.Second
+	defaultFirstByteTimeout = 30 * time.Second
+	defaultIdleTimeout      = time.Minute
 )
 
 type ReverseProxy struct {
 	To     []string `json:"to"`
 	Domain string   `json:"domain"`
+
+	// Upstreams are more places to proxy to, with settings of their own.
+	Upstreams []Upstream `json:"upstreams"`
+
+	// Strategy is how upstreams are picked: "random" (the default),
+	// "round_robin", "least_conn", "sticky" to keep clients with the same
+	// certificate on the same upstream, or "ip_hash" to keep clients with
+	// the same address on the same upstream.
+	Strategy string `json:"strategy"`
+
+	// Cache keeps responses in memory.
+	Cache *Cache `json:"cache"`
+
+	// Mirror sends copies of some requests to another upstream.
+	Mirror *Mirror `json:"mirror"`
+
+	// HealthCheck probes the upstreams periodically.
+	HealthCheck *HealthCheck `json:"health_check"`
+
+	// MaxFails is how many requests to an upstream may fail in a row
+	// before it is ejected. It defaults to 3.
+	MaxFails int `json:"max_fails"`
+
+	// Cooldown is how long an ejected upstream gets no requests. It
+	// defaults to 30 seconds.
+	Cooldown Duration `json:"cooldown"`
+
+	// RewriteLinks turns links to Domain in redirects and text/gemini
+	// responses into links to the domain the client asked for, so that
+	// the name the upstreams know themselves by doesn't leak out.
+	RewriteLinks bool `json:"rewrite_links"`
+
+	knownHosts *gemini.KnownHosts
+	upstreams  []*Upstream
+	balancer   *balancer
 }
 
-func (rp ReverseProxy) HandleGemini(w gemini.ResponseWriter, r *gemini.Request) {
-	target := rp.To[rand.Intn(len(rp.To))]
-	u, _ := url.Parse(target)
+// Upstream is a server requests are proxied to.
+type Upstream struct {
+	// URL is where the upstream listens, such as "unix:///run/app.sock",
+	// "tcp://127.0.0.1:1966" or "tls://[::1]:1966".
+	URL string `json:"url"`
+
+	// Weight is how many requests the upstream gets compared to the
+	// others. It defaults to 1.
+	Weight int `json:"weight"`
+
+	// ProxyProtocol starts every connection to the upstream with a PROXY
+	// protocol version 2 header carrying the address of the client and the
+	// server name it asked for. Upstreams built on the gemini package read
+	// it with gemini.ProxyProtocolListener.
+	ProxyProtocol bool `json:"proxy_protocol"`
+
+	// ForwardCert is how the client certificate is passed along in the
+	// PROXY protocol header: "der" sends the whole certificate,
+	// "fingerprint" only its SHA-256 fingerprint. If empty, it isn't sent.
+	ForwardCert string `json:"forward_cert"`
+
+	// TLS verifies tls:// upstreams and authenticates rhea to them. If it
+	// is not set, upstream certificates are verified against the system
+	// roots for the host of the URL.
+	TLS *UpstreamTLS `json:"tls"`
+
+	// ConnectTimeout is how long connecting to the upstream may take,
+	// including the TLS handshake. It defaults to 10 seconds.
+	ConnectTimeout Duration `json:"connect_timeout"`
+
+	// FirstByteTimeout is how long the upstream may take to start
+	// answering a request. It defaults to 30 seconds.
+	FirstByteTimeout Duration `json:"first_byte_timeout"`
+
+	// IdleTimeout is how long the upstream may go without sending anything
+	// once it started answering. There is no limit on how long a whole
+	// response may take, so big downloads keep working. It defaults to one
+	// minute.
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	u      *url.URL
+	health *upstreamHealth
+}
+
+// UpstreamTLS is how rhea talks TLS to an upstream.
+type UpstreamTLS struct {
+	// Fingerprints pins the certificate of the upstream to one of these
+	// SHA-256 fingerprints. This is the way to go for the self-signed
+	// certificates most gemini servers use.
+	Fingerprints []string `json:"fingerprints"`
+
+	// CAFile is the path of a PEM bundle of certificate authorities the
+	// upstream certificate must chain to. If neither it nor Fingerprints
+	// is set, the system roots are used.
+	CAFile string `json:"ca_file"`
+
+	// ServerName is the name the upstream certificate must be valid for
+	// and the name sent with SNI. It defaults to the host of the upstream
+	// URL.
+	ServerName string `json:"server_name"`
+
+	// InsecureSkipVerify accepts any certificate from the upstream. Only
+	// the known hosts file, if there is one, then checks that the
+	// certificate doesn't change. It can't be combined with Fingerprints
+	// or CAFile.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+
+	// CertPath and KeyPath are the client certificate rhea presents to the
+	// upstream.
+	CertPath string `json:"cert_path"`
+	KeyPath  string `json:"key_path"`
+
+	config *tls.Config
+}
+
+// load builds the TLS configuration for connecting to host.
+func (ut *UpstreamTLS) load(host string) error {
+	cfg := &tls.Config{ServerName: ut.ServerName}
+	if cfg.ServerName == "" {
+		name, _, err := net.SplitHostPort(host)
+		if err != nil {
+			return err
+		}
+		cfg.ServerName = name
+	}
+
+	if ut.InsecureSkipVerify && (ut.CAFile != "" || len(ut.Fingerprints) != 0) {
+		return fmt.Errorf("insecure_skip_verify can't be combined with ca_file or fingerprints")
+	}
+	cfg.InsecureSkipVerify = ut.InsecureSkipVerify
+
+	if ut.CAFile != "" {
+		data, err := os.ReadFile(ut.CAFile)
+		if err != nil {
+			return fmt.Errorf("can't read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in CA file %s", ut.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	// Without anything else to go on the certificate is checked against
+	// the system roots, so there have to be some.
+	if !ut.InsecureSkipVerify && ut.CAFile == "" && len(ut.Fingerprints) == 0 {
+		if _, err := x509.SystemCertPool(); err != nil {
+			return fmt.Errorf("can't load system roots, set ca_file, fingerprints or insecure_skip_verify: %v", err)
+		}
+	}
+
+	if len(ut.Fingerprints) != 0 {
+		pins := make(map[string]bool, len(ut.Fingerprints))
+		for _, fp := range ut.Fingerprints {
+			pins[strings.ToLower(fp)] = true
+		}
+
+		// Pinning replaces chain verification unless there is a CA to
+		// verify against too.
+		cfg.InsecureSkipVerify = cfg.RootCAs == nil
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("upstream sent no certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if fp := gemini.Fingerprint(cert); !pins[fp] {
+				return fmt.Errorf("upstream certificate %s is not pinned", fp)
+			}
+			return nil
+		}
+	}
+
+	if ut.CertPath != "" || ut.KeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(ut.CertPath, ut.KeyPath)
+		if err != nil {
+			return fmt.Errorf("can't load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	ut.config = cfg
+	return nil
+}
+
+// load parses the upstreams of the proxy.
+func (rp *ReverseProxy) load() error {
+	ups := make([]Upstream, 0, len(rp.To)+len(rp.Upstreams))
+	for _, to := range rp.To {
+		ups = append(ups, Upstream{URL: to})
+	}
+	ups = append(ups, rp.Upstreams...)
+
+	if len(ups) == 0 {
+		return fmt.Errorf("no upstreams")
+	}
+
+	b, err := newBalancer(rp.Strategy)
+	if err != nil {
+		return err
+	}
+	rp.balancer = b
+
+	if rp.Cache != nil {
+		if err := rp.Cache.load(rp.Domain); err != nil {
+			return fmt.Errorf("cache: %v", err)
+		}
+	}
+
+	if rp.Mirror != nil {
+		if err := rp.Mirror.load(); err != nil {
+			return fmt.Errorf("mirror: %v", err)
+		}
+	}
+
+	rp.upstreams = make([]*Upstream, 0, len(ups))
+	for _, up := range ups {
+		up := up
+		if err := up.load(); err != nil {
+			return fmt.Errorf("upstream %s: %v", up.URL, err)
+		}
+		up.health = newUpstreamHealth(rp.Domain, up.URL, rp.MaxFails, rp.Cooldown.Duration())
+		rp.upstreams = append(rp.upstreams, &up)
+	}
+
+	return nil
+}
+
+func (up *Upstream) load() error {
+	u, err := url.Parse(up.URL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "unix", "tcp", "tls":
+	default:
+		return fmt.Errorf("unknown scheme %q", u.Scheme)
+	}
+
+	if up.Weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+
+	if up.ConnectTimeout < 0 || up.FirstByteTimeout < 0 || up.IdleTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if up.ConnectTimeout == 0 {
+		up.ConnectTimeout = Duration(defaultConnectTimeout)
+	}
+	if up.FirstByteTimeout == 0 {
+		up.FirstByteTimeout = Duration(defaultFirstByteTimeout)
+	}
+	if up.IdleTimeout == 0 {
+		up.IdleTimeout = Duration(defaultIdleTimeout)
+	}
+
+	switch up.ForwardCert {
+	case "", "der", "fingerprint":
+	default:
+		return fmt.Errorf("forward_cert must be \"der\" or \"fingerprint\", not %q", up.ForwardCert)
+	}
+	if up.ForwardCert != "" && !up.ProxyProtocol {
+		return fmt.Errorf("forward_cert needs proxy_protocol")
+	}
+
+	if up.TLS != nil && u.Scheme != "tls" {
+		return fmt.Errorf("tls settings need a tls:// upstream")
+	}
+	if u.Scheme == "tls" {
+		if up.TLS == nil {
+			up.TLS = &UpstreamTLS{}
+		}
+		if err := up.TLS.load(u.Host); err != nil {
+			return err
+		}
+	}
+
+	up.u = u
+	return nil
+}
+
+func (up *Upstream) weight() int {
+	if up.Weight == 0 {
+		return 1
+	}
+	return up.Weight
+}
+
+// proxyHeader describes the client that made r for the upstream. Requests
+// rhea makes on its own, such as health checks, have no r.
+func (up *Upstream) proxyHeader(r *gemini.Request) *gemini.ProxyHeader {
+	if r == nil {
+		return &gemini.ProxyHeader{}
+	}
+
+	hdr := &gemini.ProxyHeader{
+		Source:     r.RemoteAddr,
+		ServerName: r.ServerName,
+	}
+
+	switch up.ForwardCert {
+	case "der":
+		hdr.Cert = r.Cert
+	case "fingerprint":
+		hdr.CertFingerprint = r.Fingerprint()
+	}
+
+	return hdr
+}
+
+func (rp ReverseProxy) dialUpstream(ctx context.Context, up *Upstream, r *gemini.Request) (net.Conn, error) {
+	u := up.u
+
+	ctx, cancel := context.WithTimeout(ctx, up.ConnectTimeout.Duration())
+	defer cancel()
+
+	var d net.Dialer
 	var conn net.Conn
 	var err error
-
 	switch u.Scheme {
 	case "unix":
-		conn, err = net.Dial("unix", filepath.Join("/", u.Host, u.Path))
-	case "tcp":
-		conn, err = net.Dial("tcp", u.Host)
-	case "tls":
-		conn, err = tls.Dial(
-			"tcp",
-			u.Host,
-			&tls.Config{InsecureSkipVerify: true},
-		)
+		conn, err = d.DialContext(ctx, "unix", filepath.Join("/", u.Host, u.Path))
+	case "tcp", "tls":
+		conn, err = d.DialContext(ctx, "tcp", u.Host)
+	default:
+		return nil, fmt.Errorf("unknown upstream scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The header goes before the TLS handshake, like a load balancer's
+	// would.
+	if up.ProxyProtocol {
+		if _, err := up.proxyHeader(r).WriteTo(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if u.Scheme == "tls" {
+		cfg := up.TLS.config
+		if cfg.InsecureSkipVerify && rp.knownHosts != nil {
+			cfg = cfg.Clone()
+			cfg.VerifyPeerCertificate = rp.knownHosts.VerifyPeerCertificate(u.Host)
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	return conn, nil
+}
+
+// candidates returns the upstreams that may get r, in the order they
+// should be tried.
+func (rp ReverseProxy) candidates(r *gemini.Request) []*Upstream {
+	now := time.Now()
+	result := make([]*Upstream, 0, len(rp.upstreams))
+	for _, up := range rp.upstreams {
+		if up.health.available(now) {
+			result = append(result, up)
+		}
+	}
+	return rp.balancer.order(result, r)
+}
+
+func (rp ReverseProxy) HandleGemini(w gemini.ResponseWriter, r *gemini.Request) {
+	// The mirror compares what the upstreams sent, so links are rewritten
+	// on the way to the client after it.
+	if rp.RewriteLinks && r.URL.Host != "" && !sameHost(r.URL.Host, rp.Domain) {
+		lr := newLinkRewriter(w, rp.Domain, r.URL.Host)
+		w = lr
+		defer lr.flush()
+	}
+
+	if rp.Mirror != nil && rp.Mirror.sample() {
+		if primary := rp.mirror(r); primary != nil {
+			rec := &recordingWriter{ResponseWriter: w}
+			w = rec
+			start := time.Now()
+			defer func() {
+				primary <- mirrorResult{status: rec.status, bytes: rec.bytes, duration: time.Since(start)}
+			}()
+		}
+	}
+
+	r.URL.Host = rp.Domain
+
+	if rp.Cache != nil && cacheable(r) {
+		rp.Cache.handle(w, r, rp.roundTrip)
+		return
 	}
 
+	resp, done, err := rp.roundTrip(r)
 	if err != nil {
 		w.Status(gemini.StatusProxyError, err.Error())
 		return
 	}
-	defer conn.Close()
+	defer done()
 
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	w.Status(resp.Status, resp.Meta)
+	copyBody(w, resp.Body)
+}
 
-	r.URL.Host = rp.Domain
-	fmt.Fprintf(conn, "%s\r\n", r.URL.String())
-	buf := bufio.NewReader(conn)
-	statusLineBytes, _, err := buf.ReadLine()
-	sp := strings.SplitN(string(statusLineBytes), " ", 2)
+// copyBody streams an upstream response body to the client. If the
+// upstream fails partway through, the handler is aborted so the client can
+// tell the body is cut off instead of taking it for a whole one.
+func copyBody(w io.Writer, body io.Reader) {
+	er := &errReader{r: body}
+	io.Copy(w, er)
+	if er.err != nil {
+		panic(gemini.ErrAbortHandler)
+	}
+}
+
+// errReader remembers the first error other than io.EOF of a reader.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err != nil && err != io.EOF && er.err == nil {
+		er.err = err
+	}
+	return n, err
+}
 
-	status, err := strconv.Atoi(sp[0])
+// roundTrip sends r to an upstream and returns its response. The caller
+// must call done once it is finished with the response body.
+func (rp ReverseProxy) roundTrip(r *gemini.Request) (resp *gemini.Response, done func(), err error) {
+	// Connecting is retried on the other upstreams, since nothing has been
+	// sent yet. Failures after that are not, as the upstream may already
+	// have acted on the request.
+	var up *Upstream
+	client := &gemini.Client{
+		DialContext: func(ctx context.Context, _ string) (net.Conn, error) {
+			err := errNoHealthyUpstreams
+			for _, cand := range rp.candidates(r) {
+				var conn net.Conn
+				conn, err = rp.dialUpstream(ctx, cand, r)
+				if err == nil {
+					up = cand
+					rp.balancer.acquire(up)
+					return &deadlineConn{
+						Conn:      conn,
+						firstByte: up.FirstByteTimeout.Duration(),
+						idle:      up.IdleTimeout.Duration(),
+					}, nil
+				}
+				// A client that went away says nothing about the upstream.
+				if r.Context().Err() != nil {
+					break
+				}
+				cand.health.failure(time.Now())
+				if ctx.Err() != nil {
+					break
+				}
+			}
+			return nil, err
+		},
+		CheckRedirect: func(*gemini.Request, []*gemini.Request) error {
+			return gemini.ErrUseLastResponse
+		},
+	}
+
+	resp, err = client.Do(r)
 	if err != nil {
-		w.Status(gemini.StatusTemporaryFailure, err.Error())
-		return
+		if up != nil {
+			if r.Context().Err() == nil {
+				up.health.failure(time.Now())
+			}
+			rp.balancer.release(up)
+		}
+		return nil, nil, err
+	}
+	up.health.success(time.Now())
+
+	resp.Body = &upstreamBody{ReadCloser: resp.Body, r: r, domain: rp.Domain, up: up}
+	return resp, func() {
+		resp.Body.Close()
+		rp.balancer.release(up)
+	}, nil
+}
+
+// deadlineConn enforces the first byte and idle timeouts of an upstream on
+// a connection to it.
+type deadlineConn struct {
+	net.Conn
+	firstByte, idle time.Duration
+	started         bool
+}
+
+func (dc *deadlineConn) Read(p []byte) (int, error) {
+	timeout := dc.idle
+	if !dc.started {
+		timeout = dc.firstByte
 	}
-	meta := sp[1]
-	w.Status(status, meta)
+	dc.Conn.SetReadDeadline(time.Now().Add(timeout))
 
-	io.Copy(w, conn)
+	n, err := dc.Conn.Read(p)
+	if n > 0 {
+		dc.started = true
+	}
+	return n, err
+}
+
+func (dc *deadlineConn) Write(p []byte) (int, error) {
+	dc.Conn.SetWriteDeadline(time.Now().Add(dc.idle))
+	return dc.Conn.Write(p)
+}
+
+// upstreamBody is the body of a response from up. It records the upstream
+// failing partway through the body, which the client can't be told about
+// with a status anymore.
+type upstreamBody struct {
+	io.ReadCloser
+	r      *gemini.Request
+	domain string
+	up     *Upstream
+	failed bool
+}
+
+func (ub *upstreamBody) Read(p []byte) (int, error) {
+	n, err := ub.ReadCloser.Read(p)
+	// Reads fail too when the client goes away, which is no fault of the
+	// upstream.
+	if err != nil && err != io.EOF && !ub.failed && ub.r.Context().Err() == nil {
+		ub.failed = true
+		ub.up.health.failure(time.Now())
+		upstreamTruncated.With(prometheus.Labels{"domain": ub.domain, "upstream": ub.up.URL}).Inc()
+		ln.Error(ub.r.Context(), err, ln.Action("reading upstream response"), ln.F{"domain": ub.domain, "upstream": ub.up.URL, "path": ub.r.URL.Path})
+	}
+	return n, err
 }
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdsa"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	_ "embed"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Xe/rhea/gemini"
 	"github.com/Xe/rhea/gemini/geminitest"
+	"inet.af/netaddr"
 )
 
 type testHandler struct{}
@@ -32,6 +42,32 @@ var certPem []byte
 //go:embed testdata/key.pem
 var keyPem []byte
 
+// newTestClientCert creates a self-signed client certificate.
+func newTestClientCert(t *testing.T) *x509.Certificate {
+	return geminitest.NewCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}, nil).Leaf
+}
+
+// writeCertFiles writes the certificate and its key as PEM files in dir.
+func writeCertFiles(t *testing.T, cert tls.Certificate, dir, name string) (certPath, keyPath string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, name+".pem")
+	keyPath = filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Leaf.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath
+}
+
 func TestReverseProxy(t *testing.T) {
 	t.Run("unix socket", func(t *testing.T) {
 		f, err := os.CreateTemp("", "rhea")
@@ -55,6 +91,9 @@ func TestReverseProxy(t *testing.T) {
 			To:     []string{"unix://" + fname},
 			Domain: "test.server",
 		}
+		if err := rp.load(); err != nil {
+			t.Fatal(err)
+		}
 		u, _ := url.Parse("gemini://foo.local")
 
 		rw := new(geminitest.ResponseRecorder)
@@ -79,6 +118,9 @@ func TestReverseProxy(t *testing.T) {
 			To:     []string{"tcp://" + l.Addr().String()},
 			Domain: "test.server",
 		}
+		if err := rp.load(); err != nil {
+			t.Fatal(err)
+		}
 		u, _ := url.Parse("gemini://foo.local")
 
 		rw := new(geminitest.ResponseRecorder)
@@ -106,8 +148,11 @@ func TestReverseProxy(t *testing.T) {
 		go s.Serve(l)
 
 		rp := ReverseProxy{
-			To:     []string{"tls://" + l.Addr().String()},
-			Domain: "test.server",
+			Upstreams: []Upstream{{URL: "tls://" + l.Addr().String(), TLS: &UpstreamTLS{InsecureSkipVerify: true}}},
+			Domain:    "test.server",
+		}
+		if err := rp.load(); err != nil {
+			t.Fatal(err)
 		}
 		u, _ := url.Parse("gemini://foo.local")
 
@@ -118,4 +163,376 @@ func TestReverseProxy(t *testing.T) {
 			t.Fatalf("wanted status code %d, got: %d", gemini.StatusSuccess, rw.StatusCode)
 		}
 	})
+	t.Run("malformed upstream response", func(t *testing.T) {
+		l, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprint(conn, "garbage\r\n")
+		}()
+
+		rp := ReverseProxy{
+			To:     []string{"tcp://" + l.Addr().String()},
+			Domain: "test.server",
+		}
+		if err := rp.load(); err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse("gemini://foo.local")
+
+		rw := new(geminitest.ResponseRecorder)
+		rp.HandleGemini(rw, &gemini.Request{URL: u})
+
+		if rw.StatusCode != gemini.StatusProxyError {
+			t.Fatalf("wanted status code %d, got: %d", gemini.StatusProxyError, rw.StatusCode)
+		}
+	})
+
+	t.Run("proxy protocol", func(t *testing.T) {
+		cert := newTestClientCert(t)
+
+		l, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		s := gemini.NewServer(gemini.HandlerFunc(func(w gemini.ResponseWriter, r *gemini.Request) {
+			w.Status(gemini.StatusSuccess, "text/plain")
+			fmt.Fprintf(w, "%s %s %s", r.RemoteAddr, r.ServerName, r.Fingerprint())
+		}))
+		go s.Serve(gemini.ProxyProtocolListener(l, &gemini.ProxyProtocol{TrustAll: true}))
+
+		for _, forward := range []string{"der", "fingerprint"} {
+			rp := ReverseProxy{
+				Upstreams: []Upstream{{
+					URL:           "tcp://" + l.Addr().String(),
+					ProxyProtocol: true,
+					ForwardCert:   forward,
+				}},
+				Domain: "test.server",
+			}
+			if err := rp.load(); err != nil {
+				t.Fatal(err)
+			}
+			u, _ := url.Parse("gemini://foo.local")
+
+			rw := new(geminitest.ResponseRecorder)
+			rp.HandleGemini(rw, &gemini.Request{
+				URL:        u,
+				Cert:       cert,
+				RemoteAddr: netaddr.MustParseIPPort("192.0.2.1:56324"),
+				ServerName: "foo.local",
+			})
+
+			want := "192.0.2.1:56324 foo.local " + gemini.Fingerprint(cert)
+			if got := rw.Body.String(); got != want {
+				t.Fatalf("%s: wanted upstream to see %q, got: %q", forward, want, got)
+			}
+		}
+	})
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := geminitest.NewCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	caPath, _ := writeCertFiles(t, ca, dir, "ca")
+
+	server := geminitest.NewCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "backend.test"},
+		DNSNames:    []string{"backend.test"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+
+	client := geminitest.NewCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "rhea"}}, nil)
+	clientCertPath, clientKeyPath := writeCertFiles(t, client, dir, "client")
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := gemini.NewServer(gemini.HandlerFunc(func(w gemini.ResponseWriter, r *gemini.Request) {
+		w.Status(gemini.StatusSuccess, "text/plain")
+		fmt.Fprint(w, r.Fingerprint())
+	}))
+	go s.Serve(l)
+
+	for _, tt := range []struct {
+		name   string
+		tls    UpstreamTLS
+		status int
+		body   string
+	}{
+		{
+			name:   "pinned",
+			tls:    UpstreamTLS{Fingerprints: []string{gemini.Fingerprint(server.Leaf)}},
+			status: gemini.StatusSuccess,
+		},
+		{
+			name:   "wrong pin",
+			tls:    UpstreamTLS{Fingerprints: []string{gemini.Fingerprint(ca.Leaf)}},
+			status: gemini.StatusProxyError,
+		},
+		{
+			name:   "ca",
+			tls:    UpstreamTLS{CAFile: caPath, ServerName: "backend.test"},
+			status: gemini.StatusSuccess,
+		},
+		{
+			name:   "ca with wrong server name",
+			tls:    UpstreamTLS{CAFile: caPath, ServerName: "other.test"},
+			status: gemini.StatusProxyError,
+		},
+		{
+			name:   "system roots",
+			tls:    UpstreamTLS{ServerName: "backend.test"},
+			status: gemini.StatusProxyError,
+		},
+		{
+			name:   "insecure",
+			tls:    UpstreamTLS{InsecureSkipVerify: true},
+			status: gemini.StatusSuccess,
+		},
+		{
+			name: "client certificate",
+			tls: UpstreamTLS{
+				Fingerprints: []string{gemini.Fingerprint(server.Leaf)},
+				CertPath:     clientCertPath,
+				KeyPath:      clientKeyPath,
+			},
+			status: gemini.StatusSuccess,
+			body:   gemini.Fingerprint(client.Leaf),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := ReverseProxy{
+				Upstreams: []Upstream{{URL: "tls://" + l.Addr().String(), TLS: &tt.tls}},
+				Domain:    "test.server",
+			}
+			if err := rp.load(); err != nil {
+				t.Fatal(err)
+			}
+			u, _ := url.Parse("gemini://foo.local")
+
+			rw := new(geminitest.ResponseRecorder)
+			rp.HandleGemini(rw, &gemini.Request{URL: u})
+
+			if rw.StatusCode != tt.status {
+				t.Fatalf("wanted status code %d, got: %d %s", tt.status, rw.StatusCode, rw.Meta)
+			}
+			if tt.body != "" && rw.Body.String() != tt.body {
+				t.Fatalf("wanted upstream to see client certificate %s, got: %q", tt.body, rw.Body)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSDefault(t *testing.T) {
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := gemini.NewServer(testHandler{})
+	go s.Serve(l)
+
+	rp := ReverseProxy{
+		To:     []string{"tls://" + l.Addr().String()},
+		Domain: "test.server",
+	}
+	if err := rp.load(); err != nil {
+		t.Skipf("no system roots: %v", err)
+	}
+	u, _ := url.Parse("gemini://foo.local")
+
+	rw := new(geminitest.ResponseRecorder)
+	rp.HandleGemini(rw, &gemini.Request{URL: u})
+
+	if rw.StatusCode != gemini.StatusProxyError {
+		t.Fatalf("wanted status code %d for an unverified upstream, got: %d", gemini.StatusProxyError, rw.StatusCode)
+	}
+
+	rp = ReverseProxy{
+		Upstreams: []Upstream{{
+			URL: "tls://" + l.Addr().String(),
+			TLS: &UpstreamTLS{InsecureSkipVerify: true, Fingerprints: []string{"abcd"}},
+		}},
+		Domain: "test.server",
+	}
+	if err := rp.load(); err == nil {
+		t.Fatal("wanted an error for insecure_skip_verify with fingerprints, got: nil")
+	}
+}
+
+// rawUpstream starts an upstream that reads the request line and hands the
+// connection to serve.
+func rawUpstream(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+					return
+				}
+				serve(conn)
+			}()
+		}
+	}()
+
+	return "tcp://" + l.Addr().String()
+}
+
+// proxyRaw proxies a request through to the upstream and returns the
+// response along with whether the handler aborted it.
+func proxyRaw(t *testing.T, up Upstream) (rw *geminitest.ResponseRecorder, aborted bool) {
+	t.Helper()
+
+	rp := ReverseProxy{Upstreams: []Upstream{up}, Domain: "test.server"}
+	if err := rp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if p != gemini.ErrAbortHandler {
+				panic(p)
+			}
+			aborted = true
+		}
+	}()
+
+	u, _ := url.Parse("gemini://foo.local")
+	rw = new(geminitest.ResponseRecorder)
+	rp.HandleGemini(rw, &gemini.Request{URL: u})
+	return rw, false
+}
+
+func TestReverseProxyMalformedResponse(t *testing.T) {
+	for _, header := range []string{
+		"",
+		"2\r\n",
+		"20\n",
+		"200 text/gemini\r\n",
+		"70 huh\r\n",
+		"2x text/gemini\r\n",
+		"20text/gemini\r\n",
+		"20 " + strings.Repeat("a", 1025) + "\r\n",
+	} {
+		addr := rawUpstream(t, func(conn net.Conn) {
+			io.WriteString(conn, header)
+		})
+
+		rw, _ := proxyRaw(t, Upstream{URL: addr})
+		if rw.StatusCode != gemini.StatusProxyError {
+			t.Fatalf("%q: wanted status code %d, got: %d %s", header, gemini.StatusProxyError, rw.StatusCode, rw.Meta)
+		}
+	}
+}
+
+func TestReverseProxyTimeouts(t *testing.T) {
+	t.Run("first byte", func(t *testing.T) {
+		addr := rawUpstream(t, func(conn net.Conn) {
+			time.Sleep(time.Second)
+			io.WriteString(conn, "20 text/plain\r\nlate")
+		})
+
+		start := time.Now()
+		rw, _ := proxyRaw(t, Upstream{URL: addr, FirstByteTimeout: Duration(100 * time.Millisecond)})
+		if rw.StatusCode != gemini.StatusProxyError {
+			t.Fatalf("wanted status code %d, got: %d %s", gemini.StatusProxyError, rw.StatusCode, rw.Meta)
+		}
+		if time.Since(start) > 900*time.Millisecond {
+			t.Fatalf("wanted the request to time out early, took: %v", time.Since(start))
+		}
+	})
+
+	t.Run("slow but steady body", func(t *testing.T) {
+		addr := rawUpstream(t, func(conn net.Conn) {
+			io.WriteString(conn, "20 text/plain\r\n")
+			for i := 0; i < 5; i++ {
+				time.Sleep(50 * time.Millisecond)
+				io.WriteString(conn, "chunk")
+			}
+		})
+
+		rw, aborted := proxyRaw(t, Upstream{URL: addr, IdleTimeout: Duration(150 * time.Millisecond)})
+		if aborted {
+			t.Fatal("wanted a body that keeps coming not to time out")
+		}
+		if got, want := rw.Body.String(), strings.Repeat("chunk", 5); got != want {
+			t.Fatalf("wanted body %q, got: %q", want, got)
+		}
+	})
+
+	t.Run("idle body", func(t *testing.T) {
+		addr := rawUpstream(t, func(conn net.Conn) {
+			io.WriteString(conn, "20 text/plain\r\npartial")
+			time.Sleep(time.Second)
+		})
+
+		rw, aborted := proxyRaw(t, Upstream{URL: addr, IdleTimeout: Duration(100 * time.Millisecond)})
+		if !aborted {
+			t.Fatal("wanted the stalled response to be aborted")
+		}
+		if rw.StatusCode != gemini.StatusSuccess || rw.Body.String() != "partial" {
+			t.Fatalf("wanted the partial response to be passed on, got: %d %q", rw.StatusCode, rw.Body.String())
+		}
+	})
+}
+
+func TestReverseProxyTruncatedBody(t *testing.T) {
+	addr := rawUpstream(t, func(conn net.Conn) {
+		io.WriteString(conn, "20 text/plain\r\npartial")
+		time.Sleep(50 * time.Millisecond)
+		conn.(*net.TCPConn).SetLinger(0)
+	})
+	before := counterValue(t, upstreamTruncated.WithLabelValues("test.server", addr))
+
+	rw, aborted := proxyRaw(t, Upstream{URL: addr})
+	if !aborted {
+		t.Fatal("wanted the truncated response to be aborted")
+	}
+	if rw.Body.String() != "partial" {
+		t.Fatalf("wanted the partial body to be passed on, got: %q", rw.Body.String())
+	}
+	if got := counterValue(t, upstreamTruncated.WithLabelValues("test.server", addr)); got != before+1 {
+		t.Fatalf("wanted the truncation to be counted, got: %v", got-before)
+	}
 }
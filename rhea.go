@@ -1,24 +1,121 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 
 	"github.com/Xe/rhea/gemini"
 	"github.com/mdlayher/sdnotify"
+	"inet.af/netaddr"
 )
 
 type Rhea struct {
 	cfg Config
+	srv *gemini.Server
+
+	// stop stops background work such as health checks.
+	stop context.CancelFunc
+}
+
+func New(cfg Config) (*Rhea, error) {
+	rh := &Rhea{cfg: cfg}
+	rh.srv = gemini.NewServer(rh)
+	rh.srv.HandshakeTimeout = cfg.HandshakeTimeout.Duration()
+	rh.srv.ReadTimeout = cfg.ReadTimeout.Duration()
+	rh.srv.WriteTimeout = cfg.WriteTimeout.Duration()
+	rh.srv.MaxConnections = cfg.MaxConnections
+	rh.srv.MaxConnectionsPerIP = cfg.MaxConnectionsPerIP
+
+	kh := gemini.NewKnownHosts()
+	if cfg.KnownHosts != "" {
+		var err error
+		kh, err = gemini.LoadKnownHosts(cfg.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("can't load known hosts: %v", err)
+		}
+		for _, site := range cfg.Sites {
+			if site.ReverseProxy != nil {
+				site.ReverseProxy.knownHosts = kh
+			}
+		}
+	}
+
+	if err := rh.loadAccessRules(); err != nil {
+		return nil, err
+	}
+
+	if cfg.ProxyProtocol != nil {
+		if err := cfg.ProxyProtocol.load(); err != nil {
+			return nil, fmt.Errorf("can't load proxy protocol settings: %v", err)
+		}
+	}
+	if cfg.IPRules != nil {
+		if err := cfg.IPRules.load(); err != nil {
+			return nil, fmt.Errorf("can't load global ip rules: %v", err)
+		}
+	}
+	if cfg.RateLimit != nil {
+		if err := cfg.RateLimit.load(); err != nil {
+			return nil, fmt.Errorf("can't load global rate limit: %v", err)
+		}
+	}
+	if cfg.Abuse != nil {
+		if err := cfg.Abuse.load(); err != nil {
+			return nil, fmt.Errorf("can't load abuse detection: %v", err)
+		}
+	}
+	for i := range cfg.Sites {
+		if err := cfg.Sites[i].load(); err != nil {
+			return nil, fmt.Errorf("can't load site %s: %v", cfg.Sites[i].Domain, err)
+		}
+	}
+	if cfg.ForwardProxy != nil {
+		if err := cfg.ForwardProxy.load(kh, cfg.Port); err != nil {
+			return nil, fmt.Errorf("can't load forward proxy: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rh.stop = cancel
+	for _, site := range cfg.Sites {
+		if rp := site.ReverseProxy; rp != nil && rp.HealthCheck != nil {
+			go rp.checkHealth(ctx)
+		}
+	}
+
+	return rh, nil
+}
+
+// loadAccessRules loads the allowlists of all access rules. It keeps going
+// after errors so that one broken file doesn't stop the others from being
+// reloaded, and returns the first error.
+func (rh *Rhea) loadAccessRules() error {
+	var result error
+	for _, site := range rh.cfg.Sites {
+		for i := range site.Access {
+			if err := site.Access[i].load(); err != nil && result == nil {
+				result = fmt.Errorf("can't load access rule %s for %s: %v", site.Access[i].Path, site.Domain, err)
+			}
+		}
+	}
+
+	return result
 }
 
-func New(cfg Config) Rhea {
-	return Rhea{cfg: cfg}
+// Reload re-reads the files that can change while rhea is running, such as
+// access rule allowlists. If a file can't be read, the previously loaded
+// contents stay in effect.
+func (rh *Rhea) Reload() error {
+	return rh.loadAccessRules()
 }
 
 func (rh *Rhea) tlsConfig() *tls.Config {
 	result := &tls.Config{}
+	siteConfigs := map[string]*tls.Config{}
+	requestCerts := false
 
 	for _, site := range rh.cfg.Sites {
 		cert, err := tls.LoadX509KeyPair(site.CertPath, site.KeyPath)
@@ -26,27 +123,100 @@ func (rh *Rhea) tlsConfig() *tls.Config {
 			log.Panicf("error loading certs for %s: %v", site.Domain, err)
 		}
 		result.Certificates = append(result.Certificates, cert)
+
+		// Sites that don't want certificates are recorded too, so that
+		// they aren't mistaken for forward proxy clients below.
+		siteConfigs[site.Domain] = nil
+		if site.RequestClientCerts || len(site.Access) != 0 {
+			siteConfigs[site.Domain] = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				// Gemini client certificates are self-signed, so they are
+				// requested but not verified against any CA.
+				ClientAuth: tls.RequestClientCert,
+			}
+			requestCerts = true
+		}
+	}
+
+	// Forward proxy clients may connect with any server name, or none.
+	var proxyConfig *tls.Config
+	if fp := rh.cfg.ForwardProxy; fp != nil && len(fp.Clients) != 0 {
+		proxyConfig = &tls.Config{
+			Certificates: result.Certificates,
+			ClientAuth:   tls.RequestClientCert,
+		}
+		requestCerts = true
+	}
+
+	if requestCerts {
+		result.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if cfg, ok := siteConfigs[hello.ServerName]; ok {
+				return cfg, nil
+			}
+			return proxyConfig, nil
+		}
 	}
 
 	return result
 }
 
 func (rh *Rhea) ListenAndServe() error {
-	lis, err := tls.Listen("tcp", fmt.Sprintf(":%d", rh.cfg.Port), rh.tlsConfig())
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", rh.cfg.Port))
 	if err != nil {
 		return fmt.Errorf("can't listen on port %d: %v", rh.cfg.Port, err)
 	}
-	s := gemini.NewServer(rh)
+	if rh.cfg.ProxyProtocol != nil {
+		lis = gemini.ProxyProtocolListener(lis, rh.cfg.ProxyProtocol.pp)
+	}
+	if rh.cfg.IPRules != nil || rh.cfg.Abuse != nil {
+		lis = gemini.FilterListener(lis, rh.allowedIP)
+	}
+	lis = tls.NewListener(lis, rh.tlsConfig())
 
 	n, _ := sdnotify.New()
 	n.Notify(sdnotify.Ready)
 	n.Notify(sdnotify.Statusf("serving %d sites", len(rh.cfg.Sites)))
-	return s.Serve(lis)
+	return rh.srv.Serve(lis)
+}
+
+// Shutdown stops accepting new gemini connections and waits for in-flight
+// requests to finish or for ctx to expire, whichever comes first.
+func (rh *Rhea) Shutdown(ctx context.Context) error {
+	n, _ := sdnotify.New()
+	n.Notify(sdnotify.Stopping)
+	rh.stop()
+	return rh.srv.Shutdown(ctx)
+}
+
+// allowedIP decides whether a client may connect at all.
+func (rh *Rhea) allowedIP(ip netaddr.IP) bool {
+	if rh.cfg.IPRules != nil && !rh.cfg.IPRules.filter.Allowed(ip) {
+		return false
+	}
+	if rh.cfg.Abuse != nil && rh.cfg.Abuse.detector.Bans.Banned(ip) {
+		return false
+	}
+	return true
 }
 
 func (rh *Rhea) HandleGemini(w gemini.ResponseWriter, r *gemini.Request) {
+	var h gemini.Handler = gemini.HandlerFunc(rh.route)
+
+	if rh.cfg.RateLimit != nil {
+		h = gemini.RateLimit(h, rh.cfg.RateLimit.limiter)
+	}
+
+	if rh.cfg.Abuse != nil {
+		h = gemini.DetectAbuse(h, rh.cfg.Abuse.detector)
+	}
+
+	h.HandleGemini(w, r)
+}
+
+func (rh *Rhea) route(w gemini.ResponseWriter, r *gemini.Request) {
 	if r.URL.Scheme != "gemini" {
 		w.Status(gemini.StatusProxyRequestRefused, fmt.Sprintf("can't proxy to %s", r.URL.Host))
+		return
 	}
 
 	host := r.URL.Hostname()
@@ -58,17 +228,86 @@ func (rh *Rhea) HandleGemini(w gemini.ResponseWriter, r *gemini.Request) {
 		}
 	}
 
+	if rh.cfg.ForwardProxy != nil {
+		gemini.CGIHandler(rh.cfg.ForwardProxy).HandleGemini(w, r)
+		return
+	}
+
 	w.Status(gemini.StatusProxyRequestRefused, fmt.Sprintf("can't proxy to %s", host))
 }
 
+// load prepares the parts of the site configuration that need it.
+func (s *Site) load() error {
+	if s.IPRules != nil {
+		if err := s.IPRules.load(); err != nil {
+			return fmt.Errorf("ip rules: %v", err)
+		}
+	}
+
+	if s.RateLimit != nil {
+		if err := s.RateLimit.load(); err != nil {
+			return fmt.Errorf("rate limit: %v", err)
+		}
+	}
+
+	if s.MaxConcurrentRequests > 0 {
+		s.concurrency = gemini.NewConcurrencyLimiter(s.MaxConcurrentRequests)
+	}
+
+	if s.ReverseProxy != nil {
+		if err := s.ReverseProxy.load(); err != nil {
+			return fmt.Errorf("reverse proxy: %v", err)
+		}
+	}
+
+	if s.HTTPBackend != nil {
+		if err := s.HTTPBackend.load(); err != nil {
+			return fmt.Errorf("http backend: %v", err)
+		}
+	}
+
+	return nil
+}
+
 func (s Site) HandleGemini(w gemini.ResponseWriter, r *gemini.Request) {
+	var h gemini.Handler = gemini.HandlerFunc(s.handle)
+
+	if s.HandlerTimeout > 0 {
+		h = gemini.TimeoutHandler(h, s.HandlerTimeout.Duration(), "")
+	}
+
+	if s.concurrency != nil {
+		h = gemini.LimitConcurrency(h, s.concurrency)
+	}
+
+	if len(s.Access) != 0 {
+		h = gemini.RestrictAccess(h, s.accessRules()...)
+	}
+
+	if s.RateLimit != nil {
+		h = gemini.RateLimit(h, s.RateLimit.limiter)
+	}
+
+	if s.IPRules != nil {
+		h = gemini.RestrictIPs(h, s.IPRules.filter)
+	}
+
+	h.HandleGemini(w, r)
+}
+
+func (s Site) handle(w gemini.ResponseWriter, r *gemini.Request) {
 	if s.Files != nil {
 		s.Files.HandleGemini(w, r)
 		return
 	}
 
 	if s.ReverseProxy != nil {
-		s.ReverseProxy.HandleGemini(w, r)
+		gemini.CGIHandler(s.ReverseProxy).HandleGemini(w, r)
+		return
+	}
+
+	if s.HTTPBackend != nil {
+		gemini.CGIHandler(s.HTTPBackend).HandleGemini(w, r)
 		return
 	}
 